@@ -0,0 +1,5470 @@
+// Package pipeline is the submission pipeline behind the Lambda: it fetches a
+// submission, stores it in the bucket, mails the student and records the
+// outcome. HandleRequest is the Lambda handler; Process runs one message for
+// other triggers.
+package pipeline
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/google/uuid"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/mailgun/mailgun-go/v4"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+type Structmsg struct {
+	SubmissionEmail string `json:"SubmissionEmail"`
+	SubmissionUrl   string `json:"SubmissionUrl"`
+	// SubmissionData optionally carries the zip itself, base64-encoded, in
+	// place of a URL to fetch. When both are set SubmissionData wins and
+	// SubmissionUrl is ignored. SNS caps a message at 256 KB, so this only
+	// suits small submissions.
+	SubmissionData string `json:"SubmissionData,omitempty"`
+	SubmissionId   string `json:"SubmissionId"`
+	AssignmentId   string `json:"AssignmentId"`
+	UserId         string `json:"UserId"`
+	// AssignmentType is optional and can also be set with the assignmentType
+	// message attribute, which takes precedence.
+	AssignmentType string `json:"AssignmentType,omitempty"`
+	// Locale selects the language of the notification, e.g. "es". Unknown
+	// or empty locales get the English text.
+	Locale string `json:"Locale,omitempty"`
+	// TargetBucket optionally stores the submission in another bucket than
+	// BUCKET. It must be BUCKET or listed in ALLOWED_BUCKETS.
+	TargetBucket string `json:"TargetBucket,omitempty"`
+}
+
+var ErrBucketNotAllowed = errors.New("Bucket not allowed")
+
+// Bucket is the bucket the submission is stored in: TargetBucket when set,
+// otherwise BUCKET.
+func (m Structmsg) Bucket() string {
+	if m.TargetBucket != "" {
+		return m.TargetBucket
+	}
+	return os.Getenv("BUCKET")
+}
+
+// checkBucketAllowed only lets submissions go to BUCKET and the buckets in
+// ALLOWED_BUCKETS, so a message cannot send a student's files to a bucket
+// someone else controls.
+func checkBucketAllowed(bucket string) error {
+	if bucket == os.Getenv("BUCKET") {
+		return nil
+	}
+	for _, allowed := range splitList(os.Getenv("ALLOWED_BUCKETS")) {
+		if bucket == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q is not in ALLOWED_BUCKETS", ErrBucketNotAllowed, bucket)
+}
+
+type bucketKey struct{}
+
+// bucketFrom returns the bucket of the record being processed, as set by
+// ProcessRecord, or BUCKET outside of one.
+func bucketFrom(ctx context.Context) string {
+	if bucket, ok := ctx.Value(bucketKey{}).(string); ok {
+		return bucket
+	}
+	return os.Getenv("BUCKET")
+}
+
+var signingCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var (
+	signingCertMu    sync.Mutex
+	signingCertCache = map[string]*x509.Certificate{}
+)
+
+// VerifySNSSignature checks the record's signature against the certificate
+// SNS signed it with, as described in the SNS "Verifying message signatures"
+// guide. Only certificates served over https from an SNS amazonaws.com host
+// are trusted.
+func VerifySNSSignature(ctx context.Context, entity events.SNSEntity) error {
+	cert, err := signingCert(ctx, entity.SigningCertURL)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(entity.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+
+	var canonical strings.Builder
+	add := func(k, v string) {
+		canonical.WriteString(k + "\n" + v + "\n")
+	}
+	add("Message", entity.Message)
+	add("MessageId", entity.MessageID)
+	if entity.Subject != "" {
+		add("Subject", entity.Subject)
+	}
+	add("Timestamp", entity.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"))
+	add("TopicArn", entity.TopicArn)
+	add("Type", entity.Type)
+
+	algorithm := x509.SHA1WithRSA
+	if entity.SignatureVersion == "2" {
+		algorithm = x509.SHA256WithRSA
+	} else if entity.SignatureVersion != "1" {
+		return fmt.Errorf("unsupported signature version %q", entity.SignatureVersion)
+	}
+
+	if err := cert.CheckSignature(algorithm, []byte(canonical.String()), signature); err != nil {
+		return fmt.Errorf("signature mismatch: %w", err)
+	}
+
+	return nil
+}
+
+func signingCert(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(certURL)
+	if err != nil || u.Scheme != "https" || !signingCertHost.MatchString(u.Host) {
+		return nil, fmt.Errorf("untrusted signing certificate URL %q", certURL)
+	}
+
+	signingCertMu.Lock()
+	cert, ok := signingCertCache[certURL]
+	signingCertMu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching signing certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching signing certificate: status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("reading signing certificate: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing certificate is not PEM encoded")
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing certificate: %w", err)
+	}
+
+	signingCertMu.Lock()
+	signingCertCache[certURL] = cert
+	signingCertMu.Unlock()
+
+	return cert, nil
+}
+
+func (m Structmsg) Validate() error {
+	missing := []string{}
+	if m.SubmissionUrl == "" && m.SubmissionData == "" {
+		missing = append(missing, "SubmissionUrl")
+	}
+	if m.SubmissionEmail == "" {
+		missing = append(missing, "SubmissionEmail")
+	}
+	if m.AssignmentId == "" {
+		missing = append(missing, "AssignmentId")
+	}
+	if m.SubmissionId == "" {
+		missing = append(missing, "SubmissionId")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+
+	if m.SubmissionData == "" {
+		u, err := url.Parse(m.SubmissionUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid SubmissionUrl %q", m.SubmissionUrl)
+		}
+	}
+
+	if err := checkRecipientSyntax(m.SubmissionEmail); err != nil {
+		return fmt.Errorf("invalid SubmissionEmail: %w", err)
+	}
+
+	if m.TargetBucket != "" {
+		if err := checkBucketAllowed(m.TargetBucket); err != nil {
+			return fmt.Errorf("invalid TargetBucket: %w", err)
+		}
+	}
+
+	return nil
+}
+
+var ErrInvalidRecipient = errors.New("Invalid recipient")
+
+// checkRecipientSyntax accepts a bare address whose domain has at least one
+// dot, which rules out display-name forms and local hosts that Mailgun would
+// only bounce.
+func checkRecipientSyntax(addr string) error {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return fmt.Errorf("%w %q: %w", ErrInvalidRecipient, addr, err)
+	}
+	if parsed.Address != strings.TrimSpace(addr) {
+		return fmt.Errorf("%w %q: expected a bare address", ErrInvalidRecipient, addr)
+	}
+	_, domain, _ := strings.Cut(parsed.Address, "@")
+	if !strings.Contains(strings.Trim(domain, "."), ".") {
+		return fmt.Errorf("%w %q: domain %q is not fully qualified", ErrInvalidRecipient, addr, domain)
+	}
+	return nil
+}
+
+// ValidateRecipient checks addr before a send. With
+// MAILGUN_VALIDATE_RECIPIENTS=true it also asks Mailgun's validation API and
+// rejects addresses it rates undeliverable or do_not_send; if that API fails
+// the send goes ahead on the syntax check alone.
+func ValidateRecipient(ctx context.Context, addr string) error {
+	if err := checkRecipientSyntax(addr); err != nil {
+		return err
+	}
+	if os.Getenv("MAILGUN_VALIDATE_RECIPIENTS") != "true" {
+		return nil
+	}
+
+	v, err := getEmailValidator().ValidateEmail(ctx, addr, false)
+	if err != nil {
+		loggerFrom(ctx).Warn("Error validating recipient with Mailgun, sending anyway", "stage", "mail", "error", err)
+		return nil
+	}
+	switch v.Result {
+	case "undeliverable", "do_not_send":
+		return fmt.Errorf("%w %q: Mailgun rates it %s %v", ErrInvalidRecipient, addr, v.Result, v.Reasons)
+	}
+	return nil
+}
+
+var (
+	emailValidatorOnce sync.Once
+	emailValidator     *mailgun.EmailValidatorImpl
+)
+
+func getEmailValidator() *mailgun.EmailValidatorImpl {
+	emailValidatorOnce.Do(func() {
+		emailValidator = mailgun.NewEmailValidator(os.Getenv("MAILGUN_PVT_API_KEY"))
+		base, err := mailgunAPIBase()
+		if err != nil {
+			base = mailgun.APIBaseUS
+		}
+		// Only the v4 API reports a deliverability result.
+		emailValidator.SetAPIBase(strings.TrimSuffix(base, "/v3") + "/v4")
+	})
+	return emailValidator
+}
+
+type MailStatus string
+
+const (
+	StatusSuccess        MailStatus = "SUCCESS"
+	StatusDownloadFailed MailStatus = "DOWNLOAD_FAILED"
+	// StatusUnreachable and StatusNotZip split out the download failures a
+	// student can fix: a dead link, and a link to something other than a zip.
+	StatusUnreachable    MailStatus = "UNREACHABLE"
+	StatusNotZip         MailStatus = "NOT_ZIP"
+	StatusUploadFailed   MailStatus = "UPLOAD_FAILED"
+	StatusFileTooLarge   MailStatus = "FILE_TOO_LARGE"
+	StatusFileTooSmall   MailStatus = "FILE_TOO_SMALL"
+	StatusCorruptZip     MailStatus = "CORRUPT_ZIP"
+	StatusAlreadyExists  MailStatus = "ALREADY_EXISTS"
+	StatusInvalidMessage MailStatus = "INVALID_MESSAGE"
+	StatusDuplicate      MailStatus = "DUPLICATE"
+	StatusBadSignature   MailStatus = "INVALID_SIGNATURE"
+	StatusUnknown        MailStatus = "UNKNOWN"
+)
+
+// RecordResult is the outcome of one SNS record. HandleRequest returns a JSON
+// array of these in event order, which is the function's output contract for
+// orchestration and log inspection; MailStatus is the per-record status code.
+type RecordResult struct {
+	MessageId     string     `json:"MessageId"`
+	CorrelationId string     `json:"CorrelationId"`
+	SubmissionId  string     `json:"SubmissionId"`
+	MailStatus    MailStatus `json:"MailStatus"`
+	Uploaded      bool       `json:"Uploaded,omitempty"`
+	MailSent      bool       `json:"MailSent"`
+	MailSkipped   bool       `json:"MailSkipped,omitempty"`
+	// MailDeduped is set, along with MailSkipped, when the same outcome had
+	// already been mailed for the submission.
+	MailDeduped bool `json:"MailDeduped,omitempty"`
+	// DedupedBy says what caught a DUPLICATE: "cache" for the container's
+	// recent submissions, "claim" for the table's idempotency claim.
+	DedupedBy string `json:"DedupedBy,omitempty"`
+	// UnnotifiedUpload is set when the submission was stored but the mail
+	// telling the student so failed.
+	UnnotifiedUpload bool   `json:"UnnotifiedUpload,omitempty"`
+	Error            string `json:"Error,omitempty"`
+	// Failure is the structured form of the first failure behind Error.
+	Failure   *PipelineError `json:"Failure,omitempty"`
+	MailBody  string         `json:"MailBody,omitempty"`
+	retryable bool
+}
+
+// Pipeline stages reported in PipelineError.Stage.
+const (
+	StageVerify   = "verify"
+	StageValidate = "validate"
+	StageDownload = "download"
+	StageUpload   = "upload"
+	StageMail     = "mail"
+	StageProcess  = "process"
+)
+
+// PipelineError is a failure in one stage of the pipeline. Stage and Reason
+// are stable, machine-readable codes for alerting; Message is the text of the
+// underlying error.
+type PipelineError struct {
+	Stage   string `json:"Stage"`
+	Reason  string `json:"Reason"`
+	Message string `json:"Message"`
+	Err     error  `json:"-" dynamodbav:"-"`
+}
+
+func newPipelineError(stage, reason string, err error) *PipelineError {
+	return &PipelineError{Stage: stage, Reason: reason, Message: err.Error(), Err: err}
+}
+
+func (e *PipelineError) Error() string {
+	return e.Stage + " " + e.Reason + ": " + e.Message
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+// defaultRetryable is the retry disposition of each PipelineError reason. A
+// retryable failure makes HandleRequest return an error, so SNS redelivers
+// the event (after the student got this attempt's failure mail), and its
+// claim is released so the redelivery is not skipped as a duplicate. Any
+// other failure is final: the record is kept in DynamoDB with Retryable false
+// for a human to look at.
+//
+//	stage     reason               retried
+//	verify    invalid_signature    no
+//	validate  invalid_message      no (dead-lettered)
+//	validate  invalid_recipient    no (dead-lettered)
+//	validate  bucket_not_allowed   no (dead-lettered)
+//	download  transient            yes: network errors, 5xx, 429, timeouts
+//	download  unreachable          no: 4xx other than 429
+//	download  not_zip              no
+//	download  invalid_data         no
+//	download  inflight_wait        yes: MAX_INFLIGHT_BYTES stayed full
+//	download  file_too_large       no
+//	download  file_too_small       no
+//	download  corrupt_zip          no
+//	download  blocked_host         no
+//	download  too_many_redirects   no
+//	download  unsupported_encoding no
+//	download  download_failed      no: any other download error
+//	upload    upload_failed        yes
+//	upload    retries_exhausted    yes
+//	upload    object_exists        no
+//	upload    invalid_key          no
+//	upload    file_too_large       no
+//	upload    insufficient_time    yes: too close to the Lambda deadline
+//	mail      send_failed          no: the upload already happened
+//	mail      rate_limited         no
+//	mail      invalid_recipient    no
+//	mail      not_accepted         no: a 2xx reply neither queued nor accepted
+//	process   panic                yes
+//
+// RETRY_OVERRIDES changes individual entries, e.g.
+// "rate_limited=true,upload_failed=false".
+var defaultRetryable = map[string]bool{
+	"transient":         true,
+	"upload_failed":     true,
+	"retries_exhausted": true,
+	"insufficient_time": true,
+	"inflight_wait":     true,
+	"panic":             true,
+}
+
+// RetryableReason reports whether a failure with the given reason should be
+// redelivered, see defaultRetryable.
+func RetryableReason(reason string) bool {
+	for _, override := range splitList(os.Getenv("RETRY_OVERRIDES")) {
+		name, value, _ := strings.Cut(override, "=")
+		if strings.TrimSpace(name) == reason {
+			if retry, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+				return retry
+			}
+		}
+	}
+	return defaultRetryable[reason]
+}
+
+// downloadFailureReason classifies a download error for PipelineError.
+func downloadFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrFileTooLarge):
+		return "file_too_large"
+	case errors.Is(err, ErrFileTooSmall):
+		return "file_too_small"
+	case errors.Is(err, ErrCorruptZip):
+		return "corrupt_zip"
+	case errors.Is(err, ErrBlockedHost):
+		return "blocked_host"
+	case errors.Is(err, ErrTooManyRedirects):
+		return "too_many_redirects"
+	case errors.Is(err, ErrUnreachable):
+		return "unreachable"
+	case errors.Is(err, ErrNotZip):
+		return "not_zip"
+	case errors.Is(err, ErrInvalidSubmissionData):
+		return "invalid_data"
+	case errors.Is(err, errUnsupportedEncoding):
+		return "unsupported_encoding"
+	case isRetryable(err):
+		return "transient"
+	default:
+		return "download_failed"
+	}
+}
+
+// Downloader fetches a submission from its URL.
+type Downloader interface {
+	Download(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+// Uploader stores a submission under the given object key and can hand out a
+// time-limited link to it.
+type Uploader interface {
+	Upload(ctx context.Context, key string, msg Structmsg, r io.Reader) error
+	SignedURL(ctx context.Context, key string) (string, error)
+}
+
+// Archiver keeps a durable copy of each raw SNS record as received.
+type Archiver interface {
+	Archive(ctx context.Context, key string, data []byte) error
+}
+
+// Alerter publishes a machine-readable event for a failed record, for
+// alerting bridges that should not have to parse emails.
+type Alerter interface {
+	Alert(ctx context.Context, event FailureEvent) error
+}
+
+// FailureEvent is the message published to FAILURE_TOPIC_ARN.
+type FailureEvent struct {
+	SubmissionId  string     `json:"SubmissionId"`
+	AssignmentId  string     `json:"AssignmentId"`
+	MessageId     string     `json:"MessageId"`
+	CorrelationId string     `json:"CorrelationId"`
+	MailStatus    MailStatus `json:"MailStatus"`
+	Stage         string     `json:"Stage"`
+	Reason        string     `json:"Reason"`
+	Message       string     `json:"Message"`
+	Retryable     bool       `json:"Retryable"`
+}
+
+// Notifier reports the outcome of a record over a channel other than the
+// student's email, such as a webhook or a course Slack channel. path is the
+// stored object's URI and is empty unless the upload succeeded.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, status MailStatus, msg Structmsg, path string) error
+}
+
+// NotifierOutcome is how one notification channel fared for a record.
+type NotifierOutcome struct {
+	Name  string `dynamodbav:"Name"`
+	Ok    bool   `dynamodbav:"Ok"`
+	Error string `dynamodbav:"Error,omitempty"`
+}
+
+// Mailer sends the notification email and reports what the provider
+// returned. The receipt is filled in as far as possible even when err is set.
+type Mailer interface {
+	Send(ctx context.Context, email Email) (MailReceipt, error)
+}
+
+// MailReceipt is the provider's answer to a send.
+type MailReceipt struct {
+	Response string
+	// Id is the provider's message id, used to find the mail in its logs.
+	Id string
+	// StatusCode is the HTTP status of the last attempt, or 0 if no response
+	// was received.
+	StatusCode int
+	// Status is what Mailgun made of the mail, see mailgunStatus. It is empty
+	// when no response was received.
+	Status   string
+	Attempts int
+}
+
+// Recorder persists the outcome of each record and guards against processing
+// the same submission twice.
+type Recorder interface {
+	Record(ctx context.Context, item Item)
+	DeadLetter(ctx context.Context, entry DeadLetter)
+	Claim(ctx context.Context, submissionId, messageId string) (bool, error)
+	Release(ctx context.Context, submissionId string)
+}
+
+// BatchRecorder is implemented by recorders that can write several items in
+// one call. HandleRequest uses it for events with more than one record.
+type BatchRecorder interface {
+	RecordBatch(ctx context.Context, items []Item)
+}
+
+// MailTokenRecorder is implemented by recorders that track which
+// notifications were already sent, so an SNS retry does not mail the student
+// the same outcome twice. A claimed token is settled once the send is done:
+// kept when the mail went out, released when it failed so the retry can send it.
+type MailTokenRecorder interface {
+	ClaimMailToken(ctx context.Context, token, submissionId string) (bool, error)
+	SettleMailToken(ctx context.Context, token string, sent bool)
+}
+
+// batchingRecorder holds back the items of one invocation so they can be
+// written together by flush; everything else goes straight to the wrapped
+// Recorder.
+type batchingRecorder struct {
+	Recorder
+	batch BatchRecorder
+	mu    sync.Mutex
+	items []Item
+}
+
+func (r *batchingRecorder) Record(ctx context.Context, item Item) {
+	// The correlation id lives in the record's context, which is gone by
+	// the time the batch is written.
+	if item.CorrelationId == "" {
+		item.CorrelationId = CorrelationId(ctx)
+	}
+	r.mu.Lock()
+	r.items = append(r.items, item)
+	r.mu.Unlock()
+}
+
+func (r *batchingRecorder) flush(ctx context.Context) {
+	r.mu.Lock()
+	items := r.items
+	r.items = nil
+	r.mu.Unlock()
+	if len(items) > 0 {
+		r.batch.RecordBatch(ctx, items)
+	}
+}
+
+// Processor runs the download, upload, mail and record pipeline for SNS
+// records using its pluggable dependencies.
+type Processor struct {
+	Downloader Downloader
+	Uploader   Uploader
+	Mailer     Mailer
+	Recorder   Recorder
+	// Archiver, when set, stores every record before it is processed.
+	Archiver Archiver
+	// Alerter, when set, is told about every record that fails.
+	Alerter Alerter
+	// Notifiers are told about every record after the email.
+	Notifiers []Notifier
+	// MailDisabled turns off the student email, for NOTIFIER lists without
+	// mailgun.
+	MailDisabled bool
+	// Fallback, when set, delivers the email when Mailer could not.
+	Fallback FallbackMailer
+	// Recent, when set, drops duplicate deliveries to a warm container
+	// before they reach the table's claim.
+	Recent *recentSubmissions
+	// Transform, when set, repackages the submission before upload.
+	Transform Transform
+	// DryRun adds the generated email body to each result.
+	DryRun bool
+}
+
+// NewProcessor returns a Processor wired to the HTTP downloader, GCS (or S3
+// with STORAGE_BACKEND=s3), Mailgun and DynamoDB. With DRY_RUN=true the
+// submission is still downloaded but uploads, mail and DynamoDB writes are
+// only logged.
+func NewProcessor() *Processor {
+	mail, notifiers, _ := notifiersFromEnv()
+	transform, _ := transformFor(os.Getenv("TRANSFORM"))
+	fallback, _ := fallbackFromEnv()
+	if os.Getenv("DRY_RUN") == "true" {
+		for i, n := range notifiers {
+			notifiers[i] = dryRunNotifier{name: n.Name()}
+		}
+		return &Processor{
+			Downloader:   httpDownloader{},
+			Uploader:     dryRunUploader{},
+			Mailer:       dryRunMailer{},
+			Recorder:     dryRunRecorder{},
+			Archiver:     archiverFor(dryRunArchiver{}),
+			Alerter:      alerterFor(dryRunAlerter{}),
+			Notifiers:    notifiers,
+			MailDisabled: !mail,
+			Recent:       newRecentSubmissions(getEnvInt("RECENT_SUBMISSIONS_CACHE_SIZE", 1000)),
+			Transform:    transform,
+			DryRun:       true,
+		}
+	}
+
+	var uploader Uploader = gcsUploader{}
+	if storageBackend() == BackendS3 {
+		uploader = s3Uploader{}
+	}
+	var recorder Recorder = dynamoRecorder{}
+	if writeMode() == WriteModeVersioned {
+		recorder = versionedDynamoRecorder{}
+	}
+
+	return &Processor{
+		Downloader:   httpDownloader{},
+		Uploader:     uploader,
+		Mailer:       mailgunMailer{},
+		Recorder:     recorder,
+		Archiver:     archiverFor(s3Archiver{}),
+		Alerter:      alerterFor(snsAlerter{}),
+		Notifiers:    notifiers,
+		MailDisabled: !mail,
+		Fallback:     fallback,
+		Recent:       newRecentSubmissions(getEnvInt("RECENT_SUBMISSIONS_CACHE_SIZE", 1000)),
+		Transform:    transform,
+	}
+}
+
+// recentSubmissions is an LRU of the SubmissionIds this container has claimed,
+// shared by every record of a batch. It only skips work the claim would have
+// rejected too, and entries are removed whenever the claim is released. A nil
+// cache, from a size of 0, remembers nothing.
+type recentSubmissions struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func newRecentSubmissions(size int) *recentSubmissions {
+	if size <= 0 {
+		return nil
+	}
+	return &recentSubmissions{size: size, order: list.New(), ids: map[string]*list.Element{}}
+}
+
+// Add records id and reports whether it was new. A known id is moved to the
+// front but reported as seen.
+func (c *recentSubmissions) Add(id string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.ids[id]; ok {
+		c.order.MoveToFront(e)
+		return false
+	}
+	c.ids[id] = c.order.PushFront(id)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.ids, oldest.Value.(string))
+	}
+	return true
+}
+
+func (c *recentSubmissions) Remove(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.ids[id]; ok {
+		c.order.Remove(e)
+		delete(c.ids, id)
+	}
+}
+
+// notifiersFromEnv reads NOTIFIER, a comma-separated list of channels that
+// defaults to mailgun: mailgun is the student email sent through the Mailer,
+// webhook POSTs a JSON event to NOTIFY_WEBHOOK_URL and slack posts a message
+// to the incoming webhook SLACK_WEBHOOK_URL.
+func notifiersFromEnv() (mail bool, notifiers []Notifier, err error) {
+	names := splitList(os.Getenv("NOTIFIER"))
+	if len(names) == 0 {
+		names = []string{"mailgun"}
+	}
+
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "mailgun":
+			mail = true
+		case "webhook":
+			if os.Getenv("NOTIFY_WEBHOOK_URL") == "" {
+				err = errors.New("NOTIFIER includes webhook but NOTIFY_WEBHOOK_URL is not set")
+			}
+			notifiers = append(notifiers, webhookNotifier{url: os.Getenv("NOTIFY_WEBHOOK_URL")})
+		case "slack":
+			if os.Getenv("SLACK_WEBHOOK_URL") == "" {
+				err = errors.New("NOTIFIER includes slack but SLACK_WEBHOOK_URL is not set")
+			}
+			notifiers = append(notifiers, slackNotifier{url: os.Getenv("SLACK_WEBHOOK_URL")})
+		default:
+			err = fmt.Errorf("unknown NOTIFIER %q, expected mailgun, webhook or slack", name)
+		}
+	}
+
+	return mail, notifiers, err
+}
+
+// FallbackMailer delivers the student email when Mailgun has failed, see
+// FALLBACK_NOTIFIER. Name is recorded as the channel that delivered it.
+type FallbackMailer interface {
+	Mailer
+	Name() string
+}
+
+// fallbackFromEnv returns the FallbackMailer named by FALLBACK_NOTIFIER: ses
+// sends through Amazon SES from SENDER, webhook posts the email to
+// FALLBACK_WEBHOOK_URL. It is nil when FALLBACK_NOTIFIER is unset.
+func fallbackFromEnv() (FallbackMailer, error) {
+	switch name := strings.ToLower(os.Getenv("FALLBACK_NOTIFIER")); name {
+	case "":
+		return nil, nil
+	case "ses":
+		return sesMailer{}, nil
+	case "webhook":
+		url := os.Getenv("FALLBACK_WEBHOOK_URL")
+		if url == "" {
+			return nil, errors.New("FALLBACK_NOTIFIER is webhook but FALLBACK_WEBHOOK_URL is not set")
+		}
+		return webhookMailer{url: url}, nil
+	default:
+		return nil, fmt.Errorf("unknown FALLBACK_NOTIFIER %q, expected ses or webhook", name)
+	}
+}
+
+// alerterFor returns a when FAILURE_TOPIC_ARN is set and nil otherwise.
+func alerterFor(a Alerter) Alerter {
+	if os.Getenv("FAILURE_TOPIC_ARN") == "" {
+		return nil
+	}
+	return a
+}
+
+// archiverFor returns a when ARCHIVE_EVENTS is true and nil otherwise.
+func archiverFor(a Archiver) Archiver {
+	if os.Getenv("ARCHIVE_EVENTS") != "true" {
+		return nil
+	}
+	return a
+}
+
+type httpDownloader struct{}
+
+func (httpDownloader) Download(ctx context.Context, url string) (io.ReadCloser, error) {
+	return Download(ctx, url)
+}
+
+type gcsUploader struct{}
+
+func (gcsUploader) Upload(ctx context.Context, key string, msg Structmsg, r io.Reader) error {
+	return traceCapture(ctx, "gcs.upload", func(ctx context.Context) error {
+		return UploadToBucket(ctx, key, msg, r)
+	})
+}
+
+func (gcsUploader) SignedURL(ctx context.Context, key string) (string, error) {
+	return SignedObjectURL(bucketFrom(ctx), key, time.Duration(getEnvInt("SIGNED_URL_TTL_MINUTES", 60))*time.Minute)
+}
+
+type s3Uploader struct{}
+
+func (s3Uploader) Upload(ctx context.Context, key string, msg Structmsg, r io.Reader) error {
+	return UploadToS3(ctx, key, msg, r)
+}
+
+func (s3Uploader) SignedURL(ctx context.Context, key string) (string, error) {
+	return SignedS3URL(bucketFrom(ctx), key, time.Duration(getEnvInt("SIGNED_URL_TTL_MINUTES", 60))*time.Minute)
+}
+
+type mailgunMailer struct{}
+
+func (mailgunMailer) Send(ctx context.Context, email Email) (MailReceipt, error) {
+	return SendMail(ctx, email)
+}
+
+type dynamoRecorder struct{}
+
+func (dynamoRecorder) Record(ctx context.Context, item Item) {
+	InsertToDynamo(ctx, item)
+}
+
+func (dynamoRecorder) RecordBatch(ctx context.Context, items []Item) {
+	BatchInsertToDynamo(ctx, items)
+}
+
+func (dynamoRecorder) DeadLetter(ctx context.Context, entry DeadLetter) {
+	InsertDeadLetter(ctx, entry)
+}
+
+func (dynamoRecorder) Claim(ctx context.Context, submissionId, messageId string) (bool, error) {
+	return ClaimSubmission(ctx, submissionId, messageId)
+}
+
+func (dynamoRecorder) Release(ctx context.Context, submissionId string) {
+	ReleaseSubmission(ctx, submissionId)
+}
+
+func (dynamoRecorder) ClaimMailToken(ctx context.Context, token, submissionId string) (bool, error) {
+	return ClaimMailToken(ctx, token, submissionId)
+}
+
+func (dynamoRecorder) SettleMailToken(ctx context.Context, token string, sent bool) {
+	SettleMailToken(ctx, token, sent)
+}
+
+func (dynamoRecorder) LoadRecord(ctx context.Context, submissionId string) (events.SNSEventRecord, error) {
+	return LoadLatestRecord(ctx, submissionId)
+}
+
+type dryRunUploader struct{}
+
+// Upload drains r so size limits are still enforced, without storing anything.
+func (dryRunUploader) Upload(ctx context.Context, key string, msg Structmsg, r io.Reader) error {
+	n, err := io.Copy(io.Discard, r)
+	loggerFrom(ctx).Info("Dry run: would upload object", "stage", "upload", "bucket", bucketFrom(ctx), "key", key, "bytes", n)
+	return err
+}
+
+func (dryRunUploader) SignedURL(ctx context.Context, key string) (string, error) {
+	return "", nil
+}
+
+type dryRunMailer struct{}
+
+func (dryRunMailer) Send(ctx context.Context, email Email) (MailReceipt, error) {
+	loggerFrom(ctx).Info("Dry run: would send mail", "stage", "mail", "to", email.To, "cc", email.Cc, "bcc", email.Bcc)
+	return MailReceipt{Response: "dry run"}, nil
+}
+
+type dryRunArchiver struct{}
+
+func (dryRunArchiver) Archive(ctx context.Context, key string, data []byte) error {
+	loggerFrom(ctx).Info("Dry run: would archive event", "stage", "archive", "bucket", os.Getenv("ARCHIVE_BUCKET"), "key", key, "bytes", len(data))
+	return nil
+}
+
+type dryRunAlerter struct{}
+
+func (dryRunAlerter) Alert(ctx context.Context, event FailureEvent) error {
+	loggerFrom(ctx).Info("Dry run: would publish failure", "stage", "alert", "topic", os.Getenv("FAILURE_TOPIC_ARN"), "failed_stage", event.Stage, "reason", event.Reason)
+	return nil
+}
+
+type dryRunNotifier struct {
+	name string
+}
+
+func (n dryRunNotifier) Name() string {
+	return n.name
+}
+
+func (n dryRunNotifier) Notify(ctx context.Context, status MailStatus, msg Structmsg, path string) error {
+	loggerFrom(ctx).Info("Dry run: would notify", "stage", "notify", "notifier", n.name, "mail_status", status)
+	return nil
+}
+
+type dryRunRecorder struct{}
+
+func (dryRunRecorder) Record(ctx context.Context, item Item) {
+	loggerFrom(ctx).Info("Dry run: would record item", "stage", "record", "table", os.Getenv("MAIL_TABLE"), "mail_status", item.MailStatus)
+}
+
+func (dryRunRecorder) DeadLetter(ctx context.Context, entry DeadLetter) {
+	loggerFrom(ctx).Info("Dry run: would dead-letter message", "stage", "record", "reason", entry.Reason)
+}
+
+func (dryRunRecorder) Claim(ctx context.Context, submissionId, messageId string) (bool, error) {
+	return true, nil
+}
+
+func (dryRunRecorder) Release(ctx context.Context, submissionId string) {}
+
+var defaultProcessor = NewProcessor()
+
+// Event is the payload the Lambda is invoked with: an SNS event, or
+// {"selfTest": true} to run the dependency checks in SelfTest instead.
+type Event struct {
+	events.SNSEvent
+	SelfTest bool `json:"selfTest,omitempty"`
+	// Reprocess, e.g. {"reprocess": {"submissionId": "..."}}, replays the
+	// last recorded SNS message for a submission instead.
+	Reprocess *ReprocessRequest `json:"reprocess,omitempty"`
+}
+
+// TRIGGER values selecting which event source the function is attached to:
+// SNS, handled by HandleRequest, or an SQS queue, handled by
+// HandleSQSRequest.
+const (
+	TriggerSNS = "sns"
+	TriggerSQS = "sqs"
+)
+
+// Trigger returns TRIGGER, sns by default.
+func Trigger() string {
+	if t := os.Getenv("TRIGGER"); t != "" {
+		return t
+	}
+	return TriggerSNS
+}
+
+// ReprocessRequest names the submission to run through the pipeline again.
+type ReprocessRequest struct {
+	SubmissionId string `json:"submissionId"`
+}
+
+func HandleRequest(ctx context.Context, event Event) (*string, error) {
+	if event.SelfTest {
+		report := SelfTest(ctx)
+		bReport, err := json.Marshal(report)
+		if err != nil {
+			return nil, err
+		}
+		message := string(bReport)
+		return &message, nil
+	}
+	if event.Reprocess != nil {
+		return defaultProcessor.Reprocess(ctx, event.Reprocess.SubmissionId)
+	}
+	return defaultProcessor.HandleRequest(ctx, event.SNSEvent)
+}
+
+var ErrRecordNotFound = errors.New("No recorded message for submission")
+
+// reprocessKey marks the context of a Reprocess run, whose mail is not
+// deduplicated by its mail token.
+type reprocessKey struct{}
+
+// RecordLoader is implemented by recorders that can return the SNS record
+// most recently processed for a submission.
+type RecordLoader interface {
+	LoadRecord(ctx context.Context, submissionId string) (events.SNSEventRecord, error)
+}
+
+// Reprocess replays the stored SNS record for submissionId through the
+// pipeline, e.g. after Mailgun was down. The idempotency claim is dropped
+// first so the replay is not rejected as a duplicate, but with
+// OVERWRITE_POLICY=reject a submission whose upload had succeeded is reported
+// as already existing. The replay mails the student even if the outcome it
+// reaches was mailed before, as an operator asked for it. The output has the
+// same shape as HandleRequest's.
+func (p *Processor) Reprocess(ctx context.Context, submissionId string) (*string, error) {
+	loader, ok := p.Recorder.(RecordLoader)
+	if !ok {
+		return nil, errors.New("recorder cannot load past records")
+	}
+	if submissionId == "" {
+		return nil, errors.New("reprocess request has no submissionId")
+	}
+
+	record, err := loader.LoadRecord(ctx, submissionId)
+	if err != nil {
+		loggerFrom(ctx).Error("Error loading record to reprocess", "stage", "reprocess", "submission_id", submissionId, "error", err)
+		return nil, err
+	}
+	loggerFrom(ctx).Info("Reprocessing submission", "stage", "reprocess", "submission_id", submissionId, "message_id", record.SNS.MessageID)
+
+	p.Recorder.Release(ctx, submissionId)
+	p.Recent.Remove(submissionId)
+	ctx = context.WithValue(ctx, reprocessKey{}, true)
+	return p.HandleRequest(ctx, events.SNSEvent{Records: []events.SNSEventRecord{record}})
+}
+
+// DependencyCheck is the outcome of probing one external dependency.
+type DependencyCheck struct {
+	Name       string `json:"name"`
+	Ok         bool   `json:"ok"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// SelfTestReport is returned for a self-test invocation.
+type SelfTestReport struct {
+	Ok     bool              `json:"ok"`
+	Checks []DependencyCheck `json:"checks"`
+}
+
+// SelfTest checks that the bucket, the DynamoDB tables and the Mailgun domain
+// are reachable with the configured credentials. It only reads metadata, so
+// nothing is uploaded, recorded or mailed.
+func SelfTest(ctx context.Context) SelfTestReport {
+	logger := loggerFrom(ctx).With("stage", "self_test")
+
+	check := func(name string, fn func(context.Context) (string, error)) DependencyCheck {
+		start := clock.Now()
+		detail, err := fn(ctx)
+		c := DependencyCheck{Name: name, Ok: err == nil, Detail: detail, DurationMs: clock.Now().Sub(start).Milliseconds()}
+		if err != nil {
+			c.Error = err.Error()
+			logger.Warn("Dependency check failed", "dependency", name, "error", err)
+		}
+		return c
+	}
+
+	var checks []DependencyCheck
+	if storageBackend() == BackendS3 {
+		checks = append(checks, check("s3", func(ctx context.Context) (string, error) {
+			if _, err := getS3Client().HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(os.Getenv("BUCKET"))}); err != nil {
+				return "", err
+			}
+			return os.Getenv("BUCKET"), nil
+		}))
+	} else {
+		checks = append(checks, check("gcs", func(ctx context.Context) (string, error) {
+			client, err := getStorageClient()
+			if err != nil {
+				return "", err
+			}
+			attrs, err := client.Bucket(os.Getenv("BUCKET")).Attrs(ctx)
+			if err != nil {
+				return "", err
+			}
+			return attrs.Name + " (" + attrs.Location + ")", nil
+		}))
+	}
+
+	for _, table := range []string{os.Getenv("MAIL_TABLE"), os.Getenv("DEAD_LETTER_TABLE"), os.Getenv("IDEMPOTENCY_TABLE")} {
+		if table == "" {
+			continue
+		}
+		checks = append(checks, check("dynamodb:"+table, func(ctx context.Context) (string, error) {
+			dctx, cancel := dynamoContext(ctx)
+			defer cancel()
+			out, err := getDynamoClient().DescribeTableWithContext(dctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+			if err != nil {
+				return "", err
+			}
+			if table == os.Getenv("MAIL_TABLE") {
+				if err := checkMailTableKeys(out.Table); err != nil {
+					return "", err
+				}
+			}
+			return aws.StringValue(out.Table.TableStatus), nil
+		}))
+	}
+
+	checks = append(checks, check("mailgun", func(ctx context.Context) (string, error) {
+		domain, err := getMailgun().GetDomain(ctx, os.Getenv("MAILGUN_DOMAIN"))
+		if err != nil {
+			return "", err
+		}
+		return domain.Domain.State, nil
+	}))
+
+	report := SelfTestReport{Ok: true, Checks: checks}
+	for _, c := range checks {
+		report.Ok = report.Ok && c.Ok
+	}
+	logger.Info("Self-test finished", "ok", report.Ok)
+
+	return report
+}
+
+func (p *Processor) HandleRequest(ctx context.Context, event events.SNSEvent) (*string, error) {
+	ctx = withLogger(ctx, loggerFrom(ctx).With("request_id", requestId(ctx)))
+	logger := loggerFrom(ctx)
+	logger.Info("Received event", "records", len(event.Records), "remaining_ms", remainingMillis(ctx))
+
+	// A malformed or test event can arrive with no records; there is nothing
+	// to retry, so it succeeds with an empty result list.
+	if len(event.Records) == 0 {
+		logger.Warn("Event has no records, nothing to do")
+		output := "[]"
+		return &output, nil
+	}
+
+	// SNS has no partial failure response: it delivers one record per
+	// invocation, so failing the invocation redelivers just that record.
+	results, err := p.processRecords(ctx, event.Records)
+	if err != nil {
+		return nil, err
+	}
+
+	retryable := 0
+	for _, result := range results {
+		if result.retryable {
+			retryable++
+		}
+	}
+
+	bResults, merr := json.Marshal(results)
+	if merr != nil {
+		logger.Error("Error marshalling results", "error", merr)
+		return nil, merr
+	}
+
+	output := string(bResults)
+	if retryable > 0 {
+		return &output, fmt.Errorf("%d of %d records failed with retryable errors", retryable, len(results))
+	}
+	return &output, nil
+}
+
+// processRecords runs the records of one event through the pipeline and
+// returns their results in event order, one per record. The error is only set
+// when handling the event as a whole panicked; the results still say which
+// records need to be retried.
+func (p *Processor) processRecords(ctx context.Context, records []events.SNSEventRecord) (results []RecordResult, err error) {
+	logger := loggerFrom(ctx)
+
+	// Records recover their own panics; this catches anything outside them.
+	// A record that had not finished gets a retryable failure item so it is
+	// not lost if it is never retried. Records that had finished keep their
+	// own result, so a panic after the pipeline, e.g. sending the digest,
+	// does not have them retried, and as their own items are already written
+	// nothing is added on top. Only when the batch write itself did not
+	// complete do they get a failure item, with Retryable false as their
+	// claims are held anyway. The items go through the unbatched recorder, as
+	// the batch has been flushed by then.
+	direct := p
+	results = make([]RecordResult, len(records))
+	finished, flushed := false, true
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Panic handling event", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			for i, record := range records {
+				if !finished {
+					results[i] = panicResult(record, direct.recordPanic(ctx, record, r, true))
+				} else if !flushed {
+					direct.recordPanic(ctx, record, r, false)
+				}
+			}
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	// A single record is written straight away; a batch of them is written
+	// together once every record is done.
+	if batch, ok := p.Recorder.(BatchRecorder); ok && len(records) > 1 {
+		recorder := &batchingRecorder{Recorder: p.Recorder, batch: batch}
+		flushed = false
+		defer func() {
+			recorder.flush(ctx)
+			flushed = true
+		}()
+		batched := *p
+		batched.Recorder = recorder
+		p = &batched
+	}
+
+	// Records are independent, so they run in parallel up to MAX_CONCURRENCY.
+	// Each goroutine writes only its own slot, keeping results in event order.
+	var g errgroup.Group
+	g.SetLimit(maxConcurrency())
+	for i, record := range records {
+		i, record := i, record
+		g.Go(func() error {
+			results[i] = p.processRecordRecovered(ctx, record, os.Getenv("VERIFY_SNS_SIGNATURE") == "true")
+			return nil
+		})
+	}
+	g.Wait()
+	finished = true
+
+	failed, retryable := 0, 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+		if result.retryable {
+			retryable++
+		}
+	}
+	logger.Info("Processed event", "records", len(results), "failed", failed, "retryable", retryable)
+
+	if digestMode() == DigestBatch && len(results) > 0 {
+		p.sendDigest(ctx, results)
+	}
+	return results, nil
+}
+
+// HandleSQSRequest is the handler for an SQS trigger, see Processor.HandleSQSRequest.
+func HandleSQSRequest(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	return defaultProcessor.HandleSQSRequest(ctx, event)
+}
+
+// HandleSQSRequest runs the messages of an SQS event through the same
+// pipeline as SNS records. A body is either the SNS notification itself, when
+// the queue is subscribed to the topic, or with raw message delivery the bare
+// submission message; raw messages carry no SNS signature, so they fail
+// VERIFY_SNS_SIGNATURE. Messages that failed with a retryable error are
+// reported as batch item failures, so with ReportBatchItemFailures enabled on
+// the event source mapping only they go back to the queue. Everything else is
+// deleted, the final failures included, as with SNS.
+func (p *Processor) HandleSQSRequest(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	ctx = withLogger(ctx, loggerFrom(ctx).With("request_id", requestId(ctx)))
+	loggerFrom(ctx).Info("Received SQS event", "records", len(event.Records), "remaining_ms", remainingMillis(ctx))
+
+	response := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	if len(event.Records) == 0 {
+		loggerFrom(ctx).Warn("Event has no records, nothing to do")
+		return response, nil
+	}
+
+	records := make([]events.SNSEventRecord, len(event.Records))
+	for i, message := range event.Records {
+		records[i] = snsRecordFromSQS(message)
+	}
+	// A panic outside the records still has a result for each of them, so
+	// it is reported per message rather than by failing the whole batch.
+	results, err := p.processRecords(ctx, records)
+	if err != nil {
+		loggerFrom(ctx).Error("Error handling event, reporting unfinished messages as failed", "error", err)
+	}
+
+	for i, result := range results {
+		if result.retryable {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: event.Records[i].MessageId})
+		}
+	}
+	loggerFrom(ctx).Info("Reporting batch item failures", "failures", len(response.BatchItemFailures))
+	return response, nil
+}
+
+// snsRecordFromSQS turns an SQS message into the SNS record ProcessRecord
+// expects. An SNS notification body is used as is; any other body is taken
+// as the submission message, with the SQS message id and attributes.
+func snsRecordFromSQS(message events.SQSMessage) events.SNSEventRecord {
+	record := events.SNSEventRecord{EventSource: message.EventSource, EventSubscriptionArn: message.EventSourceARN}
+
+	var entity events.SNSEntity
+	if json.Unmarshal([]byte(message.Body), &entity) == nil && entity.Type == "Notification" && entity.MessageID != "" {
+		record.SNS = entity
+		return record
+	}
+
+	record.SNS = events.SNSEntity{
+		MessageID:         message.MessageId,
+		Message:           message.Body,
+		MessageAttributes: map[string]interface{}{},
+	}
+	if ms, err := strconv.ParseInt(message.Attributes["SentTimestamp"], 10, 64); err == nil {
+		record.SNS.Timestamp = time.UnixMilli(ms).UTC()
+	}
+	for name, attr := range message.MessageAttributes {
+		if attr.StringValue != nil {
+			record.SNS.MessageAttributes[name] = map[string]interface{}{"Type": attr.DataType, "Value": *attr.StringValue}
+		}
+	}
+	return record
+}
+
+// Digest modes for DIGEST_MODE. With DIGEST_RECIPIENT set, bcc (the default)
+// copies the recipient on every notification and batch sends them one
+// summary per invocation instead, which keeps big batches from flooding their
+// inbox and also covers mails skipped by NOTIFY_ON_SUCCESS=false.
+const (
+	DigestBcc   = "bcc"
+	DigestBatch = "batch"
+)
+
+func digestMode() string {
+	if os.Getenv("DIGEST_RECIPIENT") == "" {
+		return ""
+	}
+	if mode := os.Getenv("DIGEST_MODE"); mode != "" {
+		return mode
+	}
+	return DigestBcc
+}
+
+// sendDigest mails DIGEST_RECIPIENT a summary of results. A failure is
+// only logged; the students' own mails have already gone out.
+func (p *Processor) sendDigest(ctx context.Context, results []RecordResult) {
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+
+	email := Email{
+		To:      splitList(os.Getenv("DIGEST_RECIPIENT")),
+		Subject: fmt.Sprintf("Submission digest: %d processed, %d failed", len(results), failed),
+		Body:    DigestBody(results),
+	}
+	if _, err := p.Mailer.Send(ctx, email); err != nil {
+		loggerFrom(ctx).Error("Error sending digest", "stage", "digest", "records", len(results), "error", err)
+	}
+}
+
+// DigestBody lists one line per record: submission, status, whether the
+// student was mailed, and the first failure if there was one.
+func DigestBody(results []RecordResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d submissions processed.\n\n", len(results))
+	for _, result := range results {
+		mailed := "mailed"
+		switch {
+		case result.MailSkipped:
+			mailed = "not mailed (skipped)"
+		case !result.MailSent:
+			mailed = "not mailed"
+		}
+		id := result.SubmissionId
+		if id == "" {
+			id = "message " + result.MessageId
+		}
+		fmt.Fprintf(&b, "%s: %s, %s", id, result.MailStatus, mailed)
+		if result.Error != "" {
+			fmt.Fprintf(&b, " - %s", result.Error)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func maxConcurrency() int {
+	if n := getEnvInt("MAX_CONCURRENCY", 4); n > 0 {
+		return n
+	}
+	return 1
+}
+
+var (
+	inflightOnce sync.Once
+	inflight     *semaphore.Weighted
+	inflightMax  int64
+)
+
+// getInflightLimiter returns the semaphore bounding the bytes held between
+// download and upload by every record in the process, so a batch of large
+// files cannot exhaust memory whatever MAX_CONCURRENCY is. It is sized by
+// MAX_INFLIGHT_BYTES and nil, meaning unbounded, when that is unset.
+func getInflightLimiter() (*semaphore.Weighted, int64) {
+	inflightOnce.Do(func() {
+		if n := getEnvInt("MAX_INFLIGHT_BYTES", 0); n > 0 {
+			inflight, inflightMax = semaphore.NewWeighted(int64(n)), int64(n)
+		}
+	})
+	return inflight, inflightMax
+}
+
+// inflightReservation is one record's share of MAX_INFLIGHT_BYTES. A nil
+// reservation, from an unbounded limiter, does nothing.
+type inflightReservation struct {
+	sem *semaphore.Weighted
+	n   int64
+}
+
+var ErrInflightWait = errors.New("Gave up waiting for in-flight bytes")
+
+// acquireInflight blocks until the record may start downloading. As the size
+// is not known yet, it reserves the most a submission may be,
+// MAX_DOWNLOAD_BYTES, capped at the limit so a lone record always fits. It
+// fails with ErrInflightWait when ctx ends first.
+func acquireInflight(ctx context.Context) (*inflightReservation, error) {
+	sem, limit := getInflightLimiter()
+	if sem == nil {
+		return nil, nil
+	}
+
+	n := min(int64(getEnvInt("MAX_DOWNLOAD_BYTES", 50*1024*1024)), limit)
+	if err := sem.Acquire(ctx, n); err != nil {
+		return nil, fmt.Errorf("%w: %d bytes: %w", ErrInflightWait, n, err)
+	}
+	return &inflightReservation{sem: sem, n: n}, nil
+}
+
+// shrink hands back whatever the reservation holds beyond size, once the
+// download has said how big it is. Unknown sizes keep the whole reservation.
+func (r *inflightReservation) shrink(size int64) {
+	if r == nil || size <= 0 || size >= r.n {
+		return
+	}
+	r.sem.Release(r.n - size)
+	r.n = size
+}
+
+// release returns the reservation once the body has been uploaded. It is
+// safe to call more than once.
+func (r *inflightReservation) release() {
+	if r == nil || r.n == 0 {
+		return
+	}
+	r.sem.Release(r.n)
+	r.n = 0
+}
+
+// processRecordRecovered runs processRecord, turning a panic into a retryable
+// failure for that record so it does not take down the rest of the batch.
+func (p *Processor) processRecordRecovered(ctx context.Context, record events.SNSEventRecord, verify bool) (result RecordResult) {
+	// Runs last, so it also sees failures made from a panic.
+	defer func() {
+		if result.Failure != nil && p.Alerter != nil {
+			p.alertFailure(ctx, record, result)
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			loggerFrom(ctx).Error("Panic processing record", "message_id", record.SNS.MessageID, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			result = panicResult(record, p.recordPanic(ctx, record, r, true))
+		}
+	}()
+
+	return p.processRecord(ctx, record, verify)
+}
+
+// notify runs every Notifier for the record. A failing channel is logged and
+// reported in its outcome but does not fail the record.
+func (p *Processor) notify(ctx context.Context, status MailStatus, msg Structmsg, key string) []NotifierOutcome {
+	path := ""
+	if status == StatusSuccess {
+		path = ObjectURI(bucketFrom(ctx), key)
+	}
+
+	var outcomes []NotifierOutcome
+	for _, n := range p.Notifiers {
+		outcome := NotifierOutcome{Name: n.Name(), Ok: true}
+		if err := n.Notify(ctx, status, msg, path); err != nil {
+			loggerFrom(ctx).Warn("Error notifying", "stage", "notify", "notifier", n.Name(), "error", err)
+			outcome.Ok, outcome.Error = false, err.Error()
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes
+}
+
+// mailTokens returns the recorder's MailTokenRecorder, looking through the
+// batching wrapper, or nil when it has none.
+func (p *Processor) mailTokens() MailTokenRecorder {
+	r := p.Recorder
+	if b, ok := r.(*batchingRecorder); ok {
+		r = b.Recorder
+	}
+	tokens, _ := r.(MailTokenRecorder)
+	return tokens
+}
+
+// versioner returns the recorder's ItemVersioner, looking through the
+// batching wrapper, or nil when it has none.
+func (p *Processor) versioner() ItemVersioner {
+	r := p.Recorder
+	if b, ok := r.(*batchingRecorder); ok {
+		r = b.Recorder
+	}
+	v, _ := r.(ItemVersioner)
+	return v
+}
+
+// alertFailure hands a failed record to the Alerter. A publish error is only
+// logged so it cannot replace the record's own failure.
+func (p *Processor) alertFailure(ctx context.Context, record events.SNSEventRecord, result RecordResult) {
+	msg := Structmsg{}
+	json.Unmarshal([]byte(record.SNS.Message), &msg)
+
+	event := FailureEvent{
+		SubmissionId:  result.SubmissionId,
+		AssignmentId:  msg.AssignmentId,
+		MessageId:     result.MessageId,
+		CorrelationId: result.CorrelationId,
+		MailStatus:    result.MailStatus,
+		Stage:         result.Failure.Stage,
+		Reason:        result.Failure.Reason,
+		Message:       result.Failure.Message,
+		Retryable:     result.retryable,
+	}
+	if err := p.Alerter.Alert(ctx, event); err != nil {
+		loggerFrom(ctx).Error("Error publishing failure event", "stage", "alert", "message_id", result.MessageId, "error", err)
+	}
+}
+
+// panicResult is the result of a record whose processing panicked, from the
+// failure item recordPanic wrote for it.
+func panicResult(record events.SNSEventRecord, item Item) RecordResult {
+	return RecordResult{
+		MessageId:    record.SNS.MessageID,
+		SubmissionId: item.SubmissionId,
+		MailStatus:   StatusUnknown,
+		Error:        item.Error,
+		Failure:      item.Failure,
+		retryable:    RetryableReason(item.Failure.Reason),
+	}
+}
+
+// recordPanic writes a failure item for a record whose processing panicked.
+// Like dead letters, a record without a usable SubmissionId is filed under its
+// SNS message id. retry false marks the item final whatever RETRY_OVERRIDES
+// says about panics, for records that will not be redelivered.
+func (p *Processor) recordPanic(ctx context.Context, record events.SNSEventRecord, r interface{}, retry bool) Item {
+	err := fmt.Errorf("panic: %v", r)
+	msg := Structmsg{}
+	json.Unmarshal([]byte(record.SNS.Message), &msg)
+	bRecord, _ := json.Marshal(record)
+
+	item := Item{
+		SubmissionId:    msg.SubmissionId,
+		MessageId:       record.SNS.MessageID,
+		RequestMetadata: string(bRecord),
+		MailStatus:      StatusUnknown,
+		ProcessedAt:     clock.Now().UTC().Format(time.RFC3339),
+		Error:           err.Error(),
+		Failure:         newPipelineError(StageProcess, "panic", err),
+		Retryable:       retry && RetryableReason("panic"),
+	}
+	if item.SubmissionId == "" {
+		item.SubmissionId = record.SNS.MessageID
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			loggerFrom(ctx).Error("Panic recording failure", "message_id", record.SNS.MessageID, "panic", fmt.Sprint(r))
+		}
+	}()
+	p.Recorder.Record(ctx, item)
+	return item
+}
+
+// ProcessRecord runs one SNS record through the pipeline. The signature is
+// checked first when VERIFY_SNS_SIGNATURE is true.
+func (p *Processor) ProcessRecord(ctx context.Context, record events.SNSEventRecord) RecordResult {
+	return p.processRecord(ctx, record, os.Getenv("VERIFY_SNS_SIGNATURE") == "true")
+}
+
+// Process runs msg through the pipeline for a trigger other than SNS, e.g.
+// an HTTP endpoint. The message is recorded as if it came in an SNS record
+// with a generated MessageId, and as there is no SNS signature none is
+// checked. The error is the result's Failure, nil when the record succeeded
+// or was a duplicate.
+func (p *Processor) Process(ctx context.Context, msg Structmsg) (RecordResult, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return RecordResult{}, err
+	}
+	record := events.SNSEventRecord{SNS: events.SNSEntity{
+		MessageID: uuid.NewString(),
+		Message:   string(b),
+		Timestamp: clock.Now().UTC(),
+	}}
+
+	result := p.processRecordRecovered(ctx, record, false)
+	if result.Failure != nil {
+		return result, result.Failure
+	}
+	return result, nil
+}
+
+// Process runs msg through the pipeline configured from the environment, see
+// Processor.Process.
+func Process(ctx context.Context, msg Structmsg) (RecordResult, error) {
+	return defaultProcessor.Process(ctx, msg)
+}
+
+func (p *Processor) processRecord(ctx context.Context, record events.SNSEventRecord, verify bool) RecordResult {
+	received := clock.Now()
+	msg := Structmsg{}
+	uerr := json.Unmarshal([]byte(record.SNS.Message), &msg)
+
+	correlationId := snsAttribute(record.SNS, attrCorrelationId)
+	if correlationId == "" {
+		correlationId = uuid.NewString()
+	}
+	ctx = context.WithValue(ctx, correlationKey{}, correlationId)
+
+	routing, ignored := parseRouting(record.SNS)
+	if routing.AssignmentType != "" {
+		msg.AssignmentType = routing.AssignmentType
+	}
+	ctx = context.WithValue(ctx, routingKey{}, routing)
+	ctx = withLogger(ctx, loggerFrom(ctx).With(
+		"correlation_id", correlationId,
+		"message_id", record.SNS.MessageID,
+		"submission_id", msg.SubmissionId,
+		"assignment_id", msg.AssignmentId,
+	))
+	logger := loggerFrom(ctx)
+	logger.Debug("Processing record", "message", record.SNS.Message, "high_priority", routing.HighPriority, "assignment_type", msg.AssignmentType)
+	if len(ignored) > 0 {
+		logger.Debug("Ignoring unrecognised message attributes", "attributes", ignored)
+	}
+	result := RecordResult{MessageId: record.SNS.MessageID, SubmissionId: msg.SubmissionId, CorrelationId: correlationId}
+	// fail records the first failure; later stages still run, e.g. the mail
+	// telling the student that the download failed.
+	fail := func(stage, reason string, err error) {
+		if result.Failure == nil {
+			result.Error = err.Error()
+			result.Failure = newPipelineError(stage, reason, err)
+			result.retryable = RetryableReason(reason)
+		}
+	}
+
+	bRecord, merr := json.Marshal(record)
+	if merr != nil {
+		logger.Error("Error marshalling record", "error", merr)
+	}
+
+	if p.Archiver != nil && merr == nil {
+		key := ArchiveKey(msg.SubmissionId, record.SNS.MessageID, clock.Now())
+		if err := p.Archiver.Archive(ctx, key, bRecord); err != nil {
+			logger.Error("Error archiving event, processing anyway", "stage", "archive", "key", key, "error", err)
+		}
+	}
+
+	if verify {
+		if err := VerifySNSSignature(ctx, record.SNS); err != nil {
+			logger.Error("Rejecting message with invalid signature", "stage", "verify", "error", err)
+			result.MailStatus = StatusBadSignature
+			fail(StageVerify, "invalid_signature", err)
+			return result
+		}
+	}
+
+	if uerr != nil {
+		uerr = fmt.Errorf("unparseable message: %w", uerr)
+	} else {
+		uerr = msg.Validate()
+	}
+	if uerr != nil {
+		logger.Warn("Invalid message, dead-lettering", "stage", "validate", "error", uerr)
+		result.MailStatus = StatusInvalidMessage
+		reason := "invalid_message"
+		if errors.Is(uerr, ErrInvalidRecipient) {
+			reason = "invalid_recipient"
+		} else if errors.Is(uerr, ErrBucketNotAllowed) {
+			reason = "bucket_not_allowed"
+		}
+		fail(StageValidate, reason, uerr)
+		p.Recorder.DeadLetter(ctx, DeadLetter{
+			MessageId:  record.SNS.MessageID,
+			RawMessage: record.SNS.Message,
+			Reason:     uerr.Error(),
+		})
+		return result
+	}
+	ctx = context.WithValue(ctx, bucketKey{}, msg.Bucket())
+
+	if !p.Recent.Add(msg.SubmissionId) {
+		logger.Info("Submission recently claimed by this container, skipping", "stage", "idempotency")
+		result.MailStatus = StatusDuplicate
+		result.DedupedBy = "cache"
+		return result
+	}
+
+	claimed, err := p.Recorder.Claim(ctx, msg.SubmissionId, record.SNS.MessageID)
+	if err != nil {
+		logger.Warn("Error claiming submission, processing anyway", "stage", "idempotency", "error", err)
+	} else if !claimed {
+		logger.Info("Submission already processed, skipping", "stage", "idempotency")
+		p.Recent.Remove(msg.SubmissionId)
+		result.MailStatus = StatusDuplicate
+		result.DedupedBy = "claim"
+		return result
+	}
+	// The version is read before any work, so if another run writes the
+	// submission's item while this one is processing, this run's write is
+	// the stale one and is refused.
+	var version int64
+	if v := p.versioner(); v != nil {
+		current, verr := v.ItemVersion(ctx, msg.SubmissionId)
+		if verr != nil {
+			logger.Warn("Error reading item version, checking it on write instead", "stage", "record", "error", verr)
+		} else {
+			version = current + 1
+		}
+	}
+	// The claim is also dropped if a later stage panics, so the retry of
+	// the event is not rejected as a duplicate. The cache entry goes with it.
+	done := false
+	defer func() {
+		if result.retryable || !done {
+			p.Recent.Remove(msg.SubmissionId)
+			if claimed {
+				p.Recorder.Release(ctx, msg.SubmissionId)
+			}
+		}
+	}()
+
+	metrics := PipelineMetrics{DownloadsAttempted: 1}
+	timings := stageTimings{}
+	// Waiting for in-flight room counts against the transfer deadline, so a
+	// record starved of it still has time to be recorded.
+	transferCtx, cancelTransfer := withTransferDeadline(ctx)
+	defer cancelTransfer()
+	reservation, err := acquireInflight(transferCtx)
+	defer reservation.release()
+	start := clock.Now()
+	downloadCtx, download := withDownloadInfo(transferCtx)
+	var body io.ReadCloser
+	if err != nil {
+		logger.Warn("Gave up waiting for in-flight bytes", "stage", "download", "error", err)
+	} else if msg.SubmissionData != "" {
+		logger.Info("Reading inline submission", "stage", "download", "ignored_url", msg.SubmissionUrl != "")
+		body, err = InlineSubmission(msg.SubmissionData)
+		reservation.shrink(int64(base64.StdEncoding.DecodedLen(len(msg.SubmissionData))))
+	} else {
+		logger.Info("Downloading from link", "stage", "download")
+		body, err = p.Downloader.Download(downloadCtx, msg.SubmissionUrl)
+		reservation.shrink(download.ContentLength)
+	}
+	if err == nil && os.Getenv("VALIDATE_ZIP") == "true" {
+		var validated io.Reader
+		validated, err = ValidateZip(body)
+		body.Close()
+		body = io.NopCloser(validated)
+	}
+	if err == nil && p.Transform != nil {
+		logger.Info("Transforming submission", "stage", "download", "transform", p.Transform.Name())
+		var transformed io.Reader
+		transformed, err = p.Transform.Apply(ctx, msg, body)
+		body.Close()
+		body = io.NopCloser(transformed)
+	}
+	timings.DownloadDurationMs = clock.Now().Sub(start).Milliseconds()
+	filePath := ""
+	mailStatus := StatusSuccess
+	var capture *cappedBuffer
+	var fileSHA256, objectAcl string
+	opts := BodyOptions{}
+	if err != nil {
+		metrics.DownloadsFailed = 1
+	}
+	if errors.Is(err, ErrInflightWait) {
+		metrics.DownloadsAttempted, metrics.DownloadsFailed = 0, 0
+		mailStatus = StatusDownloadFailed
+		fail(StageDownload, "inflight_wait", err)
+	} else if errors.Is(err, ErrFileTooLarge) {
+		mailStatus = StatusFileTooLarge
+		fail(StageDownload, downloadFailureReason(err), err)
+		logger.Warn("Downloaded file too large", "stage", "download", "error", err)
+	} else if errors.Is(err, ErrFileTooSmall) {
+		mailStatus = StatusFileTooSmall
+		fail(StageDownload, downloadFailureReason(err), err)
+		logger.Warn("Downloaded file too small", "stage", "download", "error", err)
+	} else if errors.Is(err, ErrCorruptZip) {
+		mailStatus = StatusCorruptZip
+		fail(StageDownload, downloadFailureReason(err), err)
+		logger.Warn("Downloaded file is not a valid zip", "stage", "download", "error", err)
+	} else if errors.Is(err, ErrNotZip) {
+		mailStatus = StatusNotZip
+		opts.ContentType = download.ContentType
+		fail(StageDownload, downloadFailureReason(err), err)
+		logger.Warn("Downloaded file is not a zip", "stage", "download", "error", err)
+	} else if errors.Is(err, ErrUnreachable) || errors.Is(err, ErrTooManyRedirects) {
+		mailStatus = StatusUnreachable
+		opts.DownloadStatusCode = download.StatusCode
+		fail(StageDownload, downloadFailureReason(err), err)
+		logger.Warn("Submission link is unreachable", "stage", "download", "error", err)
+	} else if err != nil {
+		mailStatus = StatusDownloadFailed
+		fail(StageDownload, downloadFailureReason(err), err)
+		logger.Error("Error downloading file", "stage", "download", "error", err)
+	} else {
+		err = checkRemainingTime(ctx)
+		logger.Info("Uploading to bucket", "stage", "upload", "backend", storageBackend(), "remaining_ms", remainingMillis(ctx))
+		if err == nil {
+			filePath, err = BuildObjectKey(os.Getenv("OBJECT_KEY_TEMPLATE"), msg)
+		}
+		if err == nil && overwritePolicy() == OverwriteVersion {
+			filePath += "-" + clock.Now().UTC().Format("20060102T150405.000Z")
+		}
+		if err == nil {
+			var r io.Reader = body
+			if os.Getenv("ATTACH_SUBMISSION") == "true" {
+				capture = &cappedBuffer{max: getEnvInt("ATTACHMENT_MAX_BYTES", 10*1024*1024)}
+				r = io.TeeReader(body, capture)
+			}
+			counter := &countingReader{r: r}
+			checksum := newChecksumReader(counter)
+			start = clock.Now()
+			err = p.Uploader.Upload(transferCtx, filePath, msg, checksum)
+			timings.UploadDurationMs = clock.Now().Sub(start).Milliseconds()
+			timings.FileSizeBytes = counter.n
+			if err == nil {
+				fileSHA256 = checksum.SHA256()
+			}
+		}
+		body.Close()
+		reservation.release()
+		if err == nil {
+			metrics.UploadsSucceeded = 1
+			result.Uploaded = true
+			if storageBackend() == BackendGCS {
+				objectAcl = objectACL()
+			}
+		} else {
+			metrics.UploadsFailed = 1
+		}
+		if errors.Is(err, ErrFileTooLarge) {
+			mailStatus = StatusFileTooLarge
+			fail(StageUpload, "file_too_large", err)
+			logger.Warn("Downloaded file too large", "stage", "upload", "error", err)
+		} else if errors.Is(err, ErrObjectExists) {
+			mailStatus = StatusAlreadyExists
+			fail(StageUpload, "object_exists", err)
+			logger.Warn("Refusing to overwrite existing object", "stage", "upload", "key", filePath)
+		} else if errors.Is(err, ErrInsufficientTime) {
+			mailStatus = StatusUploadFailed
+			fail(StageUpload, "insufficient_time", err)
+			logger.Warn("Not enough time left to upload, leaving it to the retry", "stage", "upload", "error", err)
+		} else if errors.Is(err, ErrInvalidObjectKey) {
+			mailStatus = StatusUploadFailed
+			fail(StageUpload, "invalid_key", err)
+			logger.Error("Object key is not valid for GCS", "stage", "upload", "error", err)
+		} else if err != nil {
+			mailStatus = StatusUploadFailed
+			reason := "upload_failed"
+			if errors.Is(err, ErrUploadRetriesExhausted) {
+				reason = "retries_exhausted"
+			}
+			fail(StageUpload, reason, err)
+			logger.Error("Error uploading file", "stage", "upload", "error", err)
+		}
+	}
+	result.MailStatus = mailStatus
+
+	// With NOTIFY_ON_SUCCESS=false only failures are mailed; a skipped mail is
+	// recorded with IsMailSent false and MailSkipped true.
+	var receipt MailReceipt
+	var mailError, deliveredBy string
+	var notifications []NotifierOutcome
+	// A record put off for lack of time or of in-flight room is not mailed;
+	// the retry mails the outcome.
+	quiet := mailStatus == StatusSuccess && os.Getenv("NOTIFY_ON_SUCCESS") == "false"
+	quiet = quiet || result.Failure != nil && (result.Failure.Reason == "insufficient_time" || result.Failure.Reason == "inflight_wait")
+	result.MailSkipped = quiet || p.MailDisabled
+	mailToken := MailToken(msg.SubmissionId, mailStatus)
+	tokens := p.mailTokens()
+	if reprocess, _ := ctx.Value(reprocessKey{}).(bool); reprocess && !result.MailSkipped && tokens != nil {
+		logger.Info("Reprocessing, mailing even if the outcome was mailed before", "stage", "mail", "mail_token", mailToken)
+	} else if !result.MailSkipped && tokens != nil {
+		fresh, terr := tokens.ClaimMailToken(ctx, mailToken, msg.SubmissionId)
+		if terr != nil {
+			logger.Warn("Error claiming mail token, sending anyway", "stage", "mail", "mail_token", mailToken, "error", terr)
+			tokens = nil
+		} else if !fresh {
+			logger.Info("Outcome already mailed, not resending", "stage", "mail", "mail_token", mailToken)
+			result.MailSkipped, result.MailDeduped = true, true
+		}
+	}
+	if result.MailSkipped {
+		logger.Info("Skipping mail", "stage", "mail", "mail_disabled", p.MailDisabled, "mail_deduped", result.MailDeduped)
+	} else {
+		email := Email{To: []string{msg.SubmissionEmail}}
+		if mailStatus != StatusSuccess {
+			email.Cc = splitList(os.Getenv("MAIL_CC"))
+			email.Bcc = splitList(os.Getenv("MAIL_BCC"))
+		}
+		if digestMode() == DigestBcc {
+			email.Bcc = append(email.Bcc, splitList(os.Getenv("DIGEST_RECIPIENT"))...)
+		}
+		if mailStatus == StatusSuccess {
+			if capture != nil && !capture.overflow {
+				email.Attachment = &Attachment{Filename: sanitizeSegment(msg.SubmissionId) + ".zip", Data: capture.buf.Bytes()}
+				opts.Attached = true
+			} else if capture != nil {
+				logger.Info("Submission too large to attach, linking instead", "stage", "mail")
+			}
+
+			if link, serr := p.Uploader.SignedURL(ctx, filePath); serr != nil {
+				logger.Warn("Error signing object URL, falling back to bucket path", "stage", "mail", "error", serr)
+			} else {
+				opts.DownloadURL = link
+			}
+		}
+
+		email.Subject = MailSubject(mailStatus, msg)
+		if email.Tags, err = MailTags(msg); err != nil {
+			logger.Warn("Too many mail tags, dropping the rest", "stage", "mail", "error", err)
+		}
+		if email.Headers, err = MailHeaders(msg); err != nil {
+			logger.Warn("Error building mail headers, sending without them", "stage", "mail", "error", err)
+			email.Headers = map[string]string{}
+		}
+		email.Headers["X-Idempotency-Token"] = mailToken
+		email.Body = GenerateBody(mailStatus, msg, filePath, opts)
+		email.HTMLBody, err = GenerateHTMLBody(mailStatus, msg, filePath, opts)
+		if err != nil {
+			logger.Warn("Error rendering HTML body, sending plain text only", "stage", "mail", "error", err)
+		}
+		if p.DryRun {
+			result.MailBody = email.Body
+		}
+		logger.Info("Sending mail", "stage", "mail")
+		receipt, err = p.Mailer.Send(ctx, email)
+		result.MailSent = err == nil
+		if err != nil {
+			mailError = err.Error()
+		}
+		notifications = append(notifications, NotifierOutcome{Name: "mailgun", Ok: result.MailSent, Error: mailError})
+		deliveredBy = "mailgun"
+		// A bad address would be refused by the fallback as well.
+		if err != nil && p.Fallback != nil && !errors.Is(err, ErrInvalidRecipient) {
+			logger.Warn("Mail failed, trying the fallback", "stage", "mail", "fallback", p.Fallback.Name(), "error", err)
+			if email.Attachment != nil {
+				email.Attachment, opts.Attached = nil, false
+				email.Body = GenerateBody(mailStatus, msg, filePath, opts)
+				email.HTMLBody, _ = GenerateHTMLBody(mailStatus, msg, filePath, opts)
+			}
+			_, ferr := p.Fallback.Send(ctx, email)
+			outcome := NotifierOutcome{Name: p.Fallback.Name(), Ok: ferr == nil}
+			if ferr != nil {
+				outcome.Error = ferr.Error()
+				logger.Error("Fallback mail failed too", "stage", "mail", "fallback", p.Fallback.Name(), "error", ferr)
+			} else {
+				deliveredBy = p.Fallback.Name()
+				result.MailSent = true
+				err = nil
+			}
+			notifications = append(notifications, outcome)
+		}
+		if !result.MailSent {
+			deliveredBy = "none"
+		}
+		if tokens != nil {
+			tokens.SettleMailToken(ctx, mailToken, result.MailSent)
+		}
+		if errors.Is(err, ErrMailRateLimited) {
+			fail(StageMail, "rate_limited", err)
+		} else if errors.Is(err, ErrInvalidRecipient) {
+			fail(StageMail, "invalid_recipient", err)
+		} else if errors.Is(err, ErrMailNotAccepted) {
+			fail(StageMail, "not_accepted", err)
+		} else if err != nil {
+			fail(StageMail, "send_failed", err)
+		}
+		if err == nil {
+			metrics.MailsSent = 1
+		} else {
+			metrics.MailsFailed = 1
+		}
+	}
+	if !quiet {
+		notifications = append(notifications, p.notify(ctx, mailStatus, msg, filePath)...)
+	}
+	result.UnnotifiedUpload = result.Uploaded && !result.MailSent && !result.MailSkipped
+	if result.UnnotifiedUpload {
+		logger.Warn("Submission uploaded but the student was not notified", "stage", "mail", "error", mailError)
+	}
+	metrics.DownloadRetries = download.Retries
+	metrics.DownloadBytesPerSec = timings.bytesPerSec()
+	EmitMetrics(msg.AssignmentId, metrics)
+
+	logger.Info("Inserting to dynamo db", "stage", "record")
+	item := Item{
+		SubmissionId:        msg.SubmissionId,
+		Bucket:              msg.Bucket(),
+		ObjectAcl:           objectAcl,
+		MessageId:           record.SNS.MessageID,
+		MailgunId:           receipt.Id,
+		MailStatusCode:      receipt.StatusCode,
+		MailgunStatus:       receipt.Status,
+		Response:            receipt.Response,
+		RequestMetadata:     string(bRecord),
+		IsUploaded:          result.Uploaded,
+		IsMailSent:          result.MailSent,
+		MailError:           mailError,
+		UnnotifiedUpload:    result.UnnotifiedUpload,
+		MailSkipped:         result.MailSkipped,
+		Notifications:       notifications,
+		MailAttempts:        receipt.Attempts,
+		MailToken:           mailToken,
+		DeliveredBy:         deliveredBy,
+		MailStatus:          mailStatus,
+		FileSizeBytes:       timings.FileSizeBytes,
+		FileSHA256:          fileSHA256,
+		DownloadStatusCode:  download.StatusCode,
+		ResolvedUrl:         download.FinalUrl,
+		DownloadContentType: download.ContentType,
+		DownloadDurationMs:  timings.DownloadDurationMs,
+		UploadDurationMs:    timings.UploadDurationMs,
+		DownloadRetries:     download.Retries,
+		DownloadBytesPerSec: timings.bytesPerSec(),
+		ProcessedAt:         clock.Now().UTC().Format(time.RFC3339),
+		TotalDurationMs:     clock.Now().Sub(received).Milliseconds(),
+		Version:             version,
+		Error:               result.Error,
+		Failure:             result.Failure,
+		Retryable:           result.retryable,
+	}
+	p.Recorder.Record(ctx, item)
+
+	done = true
+	return result
+}
+
+// PipelineMetrics holds the per-record counters published by EmitMetrics.
+type PipelineMetrics struct {
+	DownloadsAttempted int
+	DownloadsFailed    int
+	UploadsSucceeded   int
+	UploadsFailed      int
+	MailsSent          int
+	MailsFailed        int
+	DownloadRetries    int
+	// DownloadBytesPerSec is the effective rate the body was read at, see
+	// stageTimings.bytesPerSec.
+	DownloadBytesPerSec int64
+}
+
+// EmitMetrics writes m to stdout in CloudWatch Embedded Metric Format so the
+// Lambda log pipeline turns it into metrics dimensioned by AssignmentId.
+func EmitMetrics(assignmentId string, m PipelineMetrics) {
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = "SubmissionPipeline"
+	}
+
+	metrics := []struct {
+		name  string
+		unit  string
+		value int64
+	}{
+		{"DownloadsAttempted", "Count", int64(m.DownloadsAttempted)},
+		{"DownloadsFailed", "Count", int64(m.DownloadsFailed)},
+		{"UploadsSucceeded", "Count", int64(m.UploadsSucceeded)},
+		{"UploadsFailed", "Count", int64(m.UploadsFailed)},
+		{"MailsSent", "Count", int64(m.MailsSent)},
+		{"MailsFailed", "Count", int64(m.MailsFailed)},
+		{"DownloadRetries", "Count", int64(m.DownloadRetries)},
+		{"DownloadBytesPerSec", "Bytes/Second", m.DownloadBytesPerSec},
+	}
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	doc := map[string]interface{}{"AssignmentId": assignmentId}
+	for _, metric := range metrics {
+		definitions = append(definitions, map[string]string{"Name": metric.name, "Unit": metric.unit})
+		doc[metric.name] = metric.value
+	}
+	doc["_aws"] = map[string]interface{}{
+		"Timestamp": clock.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{{"AssignmentId"}},
+			"Metrics":    definitions,
+		}},
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		logger.Error("Error marshalling metrics", "error", err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(b))
+}
+
+// Item is the DynamoDB record of one processed SNS message. MAIL_TABLE is
+// keyed by SubmissionId (partition key) and RecordId (sort key), so every
+// attempt for a submission is kept, in order. The attribute names below can be
+// changed to fit an existing table with MAIL_TABLE_ATTRIBUTE_CASE and
+// MAIL_TABLE_PARTITION_KEY / MAIL_TABLE_SORT_KEY; see itemAttributeName.
+// MessageId is the SNS message id, the same id used for results and dead
+// letters; MailgunId and MailStatusCode cross-reference the send in the
+// Mailgun dashboard.
+type Item struct {
+	SubmissionId   string `dynamodbav:"SubmissionId"`
+	RecordId       string `dynamodbav:"RecordId"`
+	MessageId      string `dynamodbav:"MessageId"`
+	MailgunId      string `dynamodbav:"MailgunId,omitempty"`
+	MailStatusCode int    `dynamodbav:"MailStatusCode,omitempty"`
+	// MailgunStatus is queued, accepted or rejected, see mailgunStatus.
+	MailgunStatus   string `dynamodbav:"MailgunStatus,omitempty"`
+	CorrelationId   string `dynamodbav:"CorrelationId"`
+	Response        string `dynamodbav:"Response"`
+	Error           string `dynamodbav:"Error"`
+	RequestMetadata string `dynamodbav:"RequestMetadata"`
+	// Bucket is where the submission was stored, BUCKET or the message's
+	// TargetBucket.
+	Bucket string `dynamodbav:"Bucket,omitempty"`
+	// ObjectAcl is the OBJECT_ACL a GCS upload was written with.
+	ObjectAcl  string `dynamodbav:"ObjectAcl,omitempty"`
+	IsUploaded bool   `dynamodbav:"IsUploaded"`
+	IsMailSent bool   `dynamodbav:"IsMailSent"`
+	// MailError is the error of the failed send, kept separately from Error,
+	// which holds the first failure of the record.
+	MailError string `dynamodbav:"MailError,omitempty"`
+	// UnnotifiedUpload is set only when IsUploaded is true and the mail
+	// failed, so a reconciliation job can scan for it to find students who
+	// were never told their submission was stored.
+	UnnotifiedUpload bool `dynamodbav:"UnnotifiedUpload,omitempty"`
+	// MailSkipped is set when no mail was attempted because
+	// NOTIFY_ON_SUCCESS is false or NOTIFIER leaves out mailgun.
+	MailSkipped bool `dynamodbav:"MailSkipped,omitempty"`
+	// MailToken identifies the notification for this submission and outcome;
+	// it is also sent as the X-Idempotency-Token header.
+	MailToken string `dynamodbav:"MailToken,omitempty"`
+	// DeliveredBy is the channel that delivered the mail, mailgun or the
+	// FALLBACK_NOTIFIER, or none when all of them failed. It is empty when no
+	// mail was attempted.
+	DeliveredBy string `dynamodbav:"DeliveredBy,omitempty"`
+	// Notifications has the outcome of the mail, the fallback and each
+	// Notifier, in that order.
+	Notifications []NotifierOutcome `dynamodbav:"Notifications,omitempty"`
+	MailAttempts  int               `dynamodbav:"MailAttempts"`
+	MailStatus    MailStatus        `dynamodbav:"MailStatus"`
+	// Because the body is streamed, DownloadDurationMs covers fetching the
+	// response headers and UploadDurationMs covers moving the body to storage.
+	FileSizeBytes      int64 `dynamodbav:"FileSizeBytes"`
+	DownloadDurationMs int64 `dynamodbav:"DownloadDurationMs"`
+	UploadDurationMs   int64 `dynamodbav:"UploadDurationMs"`
+	// DownloadRetries is the number of download attempts after the first.
+	DownloadRetries     int   `dynamodbav:"DownloadRetries"`
+	DownloadBytesPerSec int64 `dynamodbav:"DownloadBytesPerSec"`
+	// ProcessedAt is when the record finished, in RFC 3339 UTC, and
+	// TotalDurationMs is the time from receiving it to writing this item,
+	// every stage and the mail included.
+	ProcessedAt     string `dynamodbav:"ProcessedAt"`
+	TotalDurationMs int64  `dynamodbav:"TotalDurationMs"`
+	// Failure is the structured form of Error, the first failure of the
+	// record, stored as a map so it can be filtered on Stage and Reason.
+	Failure *PipelineError `dynamodbav:"Failure,omitempty"`
+	// Retryable is whether Failure will be retried by SNS redelivery, see
+	// defaultRetryable.
+	Retryable bool `dynamodbav:"Retryable"`
+	// FileSHA256 is the hex SHA-256 of the uploaded bytes, also stored on the
+	// GCS object as the sha256 metadata entry.
+	FileSHA256 string `dynamodbav:"FileSHA256,omitempty"`
+	// DownloadStatusCode and DownloadContentType are what the submission
+	// server returned, after redirects. They are empty when no response was
+	// received.
+	DownloadStatusCode int `dynamodbav:"DownloadStatusCode,omitempty"`
+	// ResolvedUrl is the URL actually fetched once redirects were followed,
+	// or the redirect target that was refused, for auditing where a file
+	// came from.
+	ResolvedUrl         string `dynamodbav:"ResolvedUrl,omitempty"`
+	DownloadContentType string `dynamodbav:"DownloadContentType,omitempty"`
+	DeadLetter          bool   `dynamodbav:"DeadLetter,omitempty"`
+	// ExpiresAt is the table's TTL attribute, in unix epoch seconds.
+	ExpiresAt int64 `dynamodbav:"ExpiresAt,omitempty"`
+	// Version counts the writes of a submission's item with
+	// MAIL_TABLE_WRITE_MODE=versioned; it is 0 otherwise.
+	Version int64 `dynamodbav:"Version,omitempty"`
+}
+
+type stageTimings struct {
+	FileSizeBytes      int64
+	DownloadDurationMs int64
+	UploadDurationMs   int64
+}
+
+// bytesPerSec is the effective download rate. The body is read while it is
+// uploaded, so the rate covers both stages and is bounded by the slower of
+// the submission host and storage.
+func (t stageTimings) bytesPerSec() int64 {
+	ms := t.DownloadDurationMs + t.UploadDurationMs
+	if ms <= 0 {
+		return 0
+	}
+	return t.FileSizeBytes * 1000 / ms
+}
+
+// cappedBuffer keeps the first max bytes written to it and notes whether
+// anything beyond that was discarded.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if c.overflow {
+		return len(p), nil
+	}
+	if c.buf.Len()+len(p) > c.max {
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// checksumReader computes the SHA-256 of everything read through it, so the
+// digest is available once the upload has consumed the stream.
+type checksumReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{r: r, h: sha256.New()}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+// SHA256 returns the hex digest of the bytes read so far.
+func (c *checksumReader) SHA256() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+// checksummer is implemented by readers that know the digest of what they
+// produced, letting uploaders store it without hashing the stream again.
+type checksummer interface {
+	SHA256() string
+}
+
+var (
+	awsSessionOnce sync.Once
+	awsSession     *session.Session
+
+	dynamoOnce   sync.Once
+	dynamoClient *dynamodb.DynamoDB
+)
+
+// getAWSSession returns the AWS session shared by every client in the
+// container.
+func getAWSSession() *session.Session {
+	awsSessionOnce.Do(func() {
+		opts := session.Options{}
+		if region := os.Getenv("AWS_REGION"); region != "" {
+			opts.Config.Region = aws.String(region)
+		}
+		awsSession = session.Must(session.NewSessionWithOptions(opts))
+	})
+	return awsSession
+}
+
+// getDynamoClient returns the shared DynamoDB client. DYNAMODB_ENDPOINT
+// points it somewhere other than the regional endpoint, e.g.
+// http://localhost:8000 for DynamoDB Local; plain http disables SSL.
+func getDynamoClient() *dynamodb.DynamoDB {
+	dynamoOnce.Do(func() {
+		cfg := aws.NewConfig().WithHTTPClient(newDynamoHTTPClient())
+		if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+			cfg = cfg.WithEndpoint(endpoint).WithDisableSSL(strings.HasPrefix(endpoint, "http://"))
+		}
+		dynamoClient = dynamodb.New(getAWSSession(), cfg)
+		xray.AWS(dynamoClient.Client)
+	})
+	return dynamoClient
+}
+
+// newDynamoHTTPClient returns the HTTP client for DynamoDB. The default
+// transport keeps only 2 idle connections per host, and every DynamoDB call
+// goes to the same host, so a batch of MAX_CONCURRENCY records keeps opening
+// new TLS connections. DYNAMODB_MAX_IDLE_CONNS and
+// DYNAMODB_MAX_IDLE_CONNS_PER_HOST (both 32) size the pool, and
+// DYNAMODB_IDLE_CONN_TIMEOUT_SECONDS (30) drops connections that sat idle
+// while the container was frozen. DYNAMODB_HTTP_TIMEOUT_MS (10000) bounds
+// each HTTP attempt; DYNAMODB_TIMEOUT_MS still bounds a call with its retries.
+func newDynamoHTTPClient() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = getEnvInt("DYNAMODB_MAX_IDLE_CONNS", 32)
+	t.MaxIdleConnsPerHost = getEnvInt("DYNAMODB_MAX_IDLE_CONNS_PER_HOST", 32)
+	t.IdleConnTimeout = time.Duration(getEnvInt("DYNAMODB_IDLE_CONN_TIMEOUT_SECONDS", 30)) * time.Second
+	return &http.Client{
+		Transport: t,
+		Timeout:   time.Duration(getEnvInt("DYNAMODB_HTTP_TIMEOUT_MS", 10000)) * time.Millisecond,
+	}
+}
+
+// dynamoContext bounds a single DynamoDB call by DYNAMODB_TIMEOUT_MS, on top
+// of whatever deadline the invocation context already carries.
+func dynamoContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(getEnvInt("DYNAMODB_TIMEOUT_MS", 5000))*time.Millisecond)
+}
+
+// DeadLetter is a message that could not be processed at all, kept so
+// operators can inspect and replay it.
+type DeadLetter struct {
+	MessageId     string
+	CorrelationId string
+	RawMessage    string
+	Reason        string
+	ReceivedAt    string
+}
+
+// InsertDeadLetter writes entry to DEAD_LETTER_TABLE (partition key
+// MessageId). Without a dead-letter table the entry goes to MAIL_TABLE as an
+// item with DeadLetter set, so it is still queryable; as the message may have
+// no usable SubmissionId, it is filed under the SNS message id instead.
+func InsertDeadLetter(ctx context.Context, entry DeadLetter) {
+	entry.ReceivedAt = clock.Now().UTC().Format(time.RFC3339)
+	entry.CorrelationId = CorrelationId(ctx)
+
+	table := os.Getenv("DEAD_LETTER_TABLE")
+	if table == "" {
+		InsertToDynamo(ctx, Item{
+			MessageId:       entry.MessageId,
+			Error:           entry.Reason,
+			RequestMetadata: entry.RawMessage,
+			MailStatus:      StatusInvalidMessage,
+			DeadLetter:      true,
+		})
+		return
+	}
+
+	svc := getDynamoClient()
+
+	av, err := dynamodbattribute.MarshalMap(entry)
+	if err != nil {
+		loggerFrom(ctx).Error("Error marshalling dead letter", "stage", "record", "table", table, "key", entry.MessageId, "error", err)
+		return
+	}
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	_, err = svc.PutItemWithContext(dctx, &dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(table),
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("Error calling PutItem", "stage", "record", "table", table, "key", entry.MessageId, "error", err)
+	}
+}
+
+// LoadLatestRecord returns the SNS record stored in RequestMetadata of the
+// newest MAIL_TABLE item for submissionId.
+func LoadLatestRecord(ctx context.Context, submissionId string) (events.SNSEventRecord, error) {
+	var record events.SNSEventRecord
+	table := os.Getenv("MAIL_TABLE")
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	out, err := getDynamoClient().QueryWithContext(dctx, &dynamodb.QueryInput{
+		TableName:                aws.String(table),
+		KeyConditionExpression:   aws.String("#pk = :id"),
+		ExpressionAttributeNames: map[string]*string{"#pk": aws.String(itemAttributeName("SubmissionId"))},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id": {S: aws.String(submissionId)},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(1),
+	})
+	if err != nil {
+		return record, err
+	}
+	if len(out.Items) == 0 {
+		return record, fmt.Errorf("%w %s", ErrRecordNotFound, submissionId)
+	}
+
+	if err := json.Unmarshal([]byte(itemString(out.Items[0], "RequestMetadata")), &record); err != nil {
+		return record, fmt.Errorf("stored request metadata for %s is not an SNS record: %w", submissionId, err)
+	}
+
+	return record, nil
+}
+
+// itemAttributeName maps an Item attribute to the name MAIL_TABLE uses for
+// it. MAIL_TABLE_PARTITION_KEY and MAIL_TABLE_SORT_KEY rename the
+// SubmissionId and RecordId keys, e.g. to PK and SK; with
+// MAIL_TABLE_ATTRIBUTE_CASE=snake every other attribute, including those
+// inside Failure, is written in snake_case (file_sha256, expires_at, ...).
+func itemAttributeName(name string) string {
+	switch name {
+	case "SubmissionId":
+		if key := os.Getenv("MAIL_TABLE_PARTITION_KEY"); key != "" {
+			return key
+		}
+	case "RecordId":
+		if key := os.Getenv("MAIL_TABLE_SORT_KEY"); key != "" {
+			return key
+		}
+	}
+	if os.Getenv("MAIL_TABLE_ATTRIBUTE_CASE") == "snake" {
+		return snakeCase(name)
+	}
+	return name
+}
+
+// snakeCase converts a Go-style name to snake_case, keeping initialisms
+// together: "FileSHA256" becomes "file_sha256".
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// marshalItem marshals item into the attribute names MAIL_TABLE expects.
+func marshalItem(item Item) (map[string]*dynamodb.AttributeValue, error) {
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return nil, err
+	}
+	return renameAttributes(av, true), nil
+}
+
+func renameAttributes(av map[string]*dynamodb.AttributeValue, top bool) map[string]*dynamodb.AttributeValue {
+	renamed := make(map[string]*dynamodb.AttributeValue, len(av))
+	for name, v := range av {
+		if v.M != nil {
+			v.M = renameAttributes(v.M, false)
+		}
+		if top {
+			name = itemAttributeName(name)
+		} else if os.Getenv("MAIL_TABLE_ATTRIBUTE_CASE") == "snake" {
+			name = snakeCase(name)
+		}
+		renamed[name] = v
+	}
+	return renamed
+}
+
+// checkMailTableKeys reports whether MAIL_TABLE's key schema matches the
+// configured partition and sort key names.
+func checkMailTableKeys(table *dynamodb.TableDescription) error {
+	want := map[string]string{
+		dynamodb.KeyTypeHash:  itemAttributeName("SubmissionId"),
+		dynamodb.KeyTypeRange: itemAttributeName("RecordId"),
+	}
+	got := map[string]string{}
+	for _, k := range table.KeySchema {
+		got[aws.StringValue(k.KeyType)] = aws.StringValue(k.AttributeName)
+	}
+	if got[dynamodb.KeyTypeHash] != want[dynamodb.KeyTypeHash] || got[dynamodb.KeyTypeRange] != want[dynamodb.KeyTypeRange] {
+		return fmt.Errorf("key schema is %s/%s, want %s/%s", got[dynamodb.KeyTypeHash], got[dynamodb.KeyTypeRange], want[dynamodb.KeyTypeHash], want[dynamodb.KeyTypeRange])
+	}
+	return nil
+}
+
+// itemString returns the string attribute of a MAIL_TABLE item by its Item
+// field name.
+func itemString(av map[string]*dynamodb.AttributeValue, name string) string {
+	if v := av[itemAttributeName(name)]; v != nil {
+		return aws.StringValue(v.S)
+	}
+	return ""
+}
+
+// recordIdTimeLayout is fixed width so RecordIds sort chronologically.
+const recordIdTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// InsertToDynamo writes item to MAIL_TABLE. The RecordId sort key is the
+// current time followed by the Mailgun id, or a random UUID when there is
+// none, so two attempts never overwrite each other.
+func InsertToDynamo(ctx context.Context, item Item) {
+	table := os.Getenv("MAIL_TABLE")
+	svc := getDynamoClient()
+
+	item = prepareItem(ctx, item)
+	av, err := marshalItem(item)
+	if err != nil {
+		loggerFrom(ctx).Error("Error marshalling new item", "stage", "record", "table", table, "key", item.RecordId, "error", err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:                     av,
+		TableName:                aws.String(table),
+		ConditionExpression:      aws.String("attribute_not_exists(#sk)"),
+		ExpressionAttributeNames: map[string]*string{"#sk": aws.String(itemAttributeName("RecordId"))},
+	}
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	_, err = svc.PutItemWithContext(dctx, input)
+	if err != nil {
+		loggerFrom(ctx).Error("Error calling PutItem", "stage", "record", "table", table, "key", item.RecordId, "error", err)
+	}
+}
+
+// MAIL_TABLE_WRITE_MODE values. "append", the default, writes a new item for
+// every attempt. "versioned" keeps a single item per submission, under the
+// RecordId latestRecordId, and every write of it increments Version.
+const (
+	WriteModeAppend    = "append"
+	WriteModeVersioned = "versioned"
+)
+
+func writeMode() string {
+	if m := os.Getenv("MAIL_TABLE_WRITE_MODE"); m != "" {
+		return m
+	}
+	return WriteModeAppend
+}
+
+// latestRecordId is the RecordId of the item kept per submission in versioned
+// mode. It sorts after the timestamped RecordIds, so LoadLatestRecord still
+// finds it first.
+const latestRecordId = "LATEST"
+
+// ErrStaleWrite is returned for a versioned write whose item was written by
+// someone else since its version was read.
+var ErrStaleWrite = errors.New("Stale write")
+
+// ItemVersioner is implemented by recorders that keep a versioned item per
+// submission. ItemVersion returns the stored version, 0 when there is none.
+type ItemVersioner interface {
+	ItemVersion(ctx context.Context, submissionId string) (int64, error)
+}
+
+// versionedDynamoRecorder is the dynamoRecorder with
+// MAIL_TABLE_WRITE_MODE=versioned. Batches are written one item at a time,
+// as BatchWriteItem cannot be conditional.
+type versionedDynamoRecorder struct {
+	dynamoRecorder
+}
+
+func (versionedDynamoRecorder) Record(ctx context.Context, item Item) {
+	PutVersionedItem(ctx, item)
+}
+
+func (r versionedDynamoRecorder) RecordBatch(ctx context.Context, items []Item) {
+	for _, item := range items {
+		r.Record(ctx, item)
+	}
+}
+
+func (versionedDynamoRecorder) ItemVersion(ctx context.Context, submissionId string) (int64, error) {
+	table := os.Getenv("MAIL_TABLE")
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	out, err := getDynamoClient().GetItemWithContext(dctx, &dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			itemAttributeName("SubmissionId"): {S: aws.String(submissionId)},
+			itemAttributeName("RecordId"):     {S: aws.String(latestRecordId)},
+		},
+		ProjectionExpression:     aws.String("#v"),
+		ExpressionAttributeNames: map[string]*string{"#v": aws.String(itemAttributeName("Version"))},
+		ConsistentRead:           aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+	v, ok := out.Item[itemAttributeName("Version")]
+	if !ok || v.N == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(*v.N, 10, 64)
+}
+
+// PutVersionedItem writes item as its submission's single MAIL_TABLE item. It
+// is only written if the stored item is at item.Version-1, or absent for
+// version 1, so a run that read an older version than the one stored now
+// gets ErrStaleWrite instead of overwriting the newer result. An item
+// without a Version, e.g. for a panic, takes the next one at write time.
+func PutVersionedItem(ctx context.Context, item Item) error {
+	table := os.Getenv("MAIL_TABLE")
+
+	if item.Version == 0 {
+		current, err := versionedDynamoRecorder{}.ItemVersion(ctx, item.SubmissionId)
+		if err != nil {
+			loggerFrom(ctx).Error("Error reading item version", "stage", "record", "table", table, "error", err)
+			return err
+		}
+		item.Version = current + 1
+	}
+	item = prepareItem(ctx, item)
+	item.RecordId = latestRecordId
+	av, err := marshalItem(item)
+	if err != nil {
+		loggerFrom(ctx).Error("Error marshalling new item", "stage", "record", "table", table, "key", item.RecordId, "error", err)
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:                     av,
+		TableName:                aws.String(table),
+		ConditionExpression:      aws.String("attribute_not_exists(#sk)"),
+		ExpressionAttributeNames: map[string]*string{"#sk": aws.String(itemAttributeName("RecordId"))},
+	}
+	if item.Version > 1 {
+		input.ConditionExpression = aws.String("#v = :v")
+		input.ExpressionAttributeNames = map[string]*string{"#v": aws.String(itemAttributeName("Version"))}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":v": {N: aws.String(strconv.FormatInt(item.Version-1, 10))},
+		}
+	}
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	_, err = getDynamoClient().PutItemWithContext(dctx, input)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		err = fmt.Errorf("%w: %s was written by another run since version %d was read", ErrStaleWrite, item.SubmissionId, item.Version-1)
+		loggerFrom(ctx).Error("Refusing stale write", "stage", "record", "table", table, "version", item.Version, "error", err)
+		return err
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Error calling PutItem", "stage", "record", "table", table, "key", item.RecordId, "error", err)
+	}
+	return err
+}
+
+// prepareItem fills in the fields every MAIL_TABLE item gets on write: the
+// correlation id, the RecordId sort key and the TTL. The free-text fields are
+// cut to RECORD_FIELD_MAX_CHARS (4096 by default, 0 for no limit), so a huge
+// error or Mailgun response cannot push the item past DynamoDB's 400 KB.
+func prepareItem(ctx context.Context, item Item) Item {
+	limit := getEnvInt("RECORD_FIELD_MAX_CHARS", 4096)
+	item.Response = ellipsize(item.Response, limit)
+	item.Error = ellipsize(item.Error, limit)
+	item.MailError = ellipsize(item.MailError, limit)
+	if item.Failure != nil {
+		failure := *item.Failure
+		failure.Message = ellipsize(failure.Message, limit)
+		item.Failure = &failure
+	}
+
+	if item.CorrelationId == "" {
+		item.CorrelationId = CorrelationId(ctx)
+	}
+	if item.SubmissionId == "" {
+		item.SubmissionId = item.MessageId
+	}
+	suffix := item.MailgunId
+	if suffix == "" {
+		suffix = uuid.NewString()
+	}
+	item.RecordId = clock.Now().UTC().Format(recordIdTimeLayout) + "#" + suffix
+
+	if ttlDays := getEnvInt("RECORD_TTL_DAYS", 90); ttlDays > 0 {
+		item.ExpiresAt = clock.Now().Add(time.Duration(ttlDays) * 24 * time.Hour).Unix()
+	}
+	return item
+}
+
+// maxBatchWriteItems is the most items BatchWriteItem accepts in one call.
+const maxBatchWriteItems = 25
+
+// BatchInsertToDynamo writes items to MAIL_TABLE with BatchWriteItem, 25 at a
+// time, resubmitting UnprocessedItems with backoff up to
+// DYNAMODB_BATCH_MAX_RETRIES times. BatchWriteItem takes no condition
+// expression, which is safe as every RecordId is unique. Items that are still
+// not written are logged one by one.
+func BatchInsertToDynamo(ctx context.Context, items []Item) {
+	table := os.Getenv("MAIL_TABLE")
+	svc := getDynamoClient()
+
+	requests := make([]*dynamodb.WriteRequest, 0, len(items))
+	for _, item := range items {
+		item = prepareItem(ctx, item)
+		av, err := marshalItem(item)
+		if err != nil {
+			loggerFrom(ctx).Error("Error marshalling new item", "stage", "record", "table", table, "submission_id", item.SubmissionId, "key", item.RecordId, "error", err)
+			continue
+		}
+		requests = append(requests, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: av}})
+	}
+
+	for start := 0; start < len(requests); start += maxBatchWriteItems {
+		end := min(start+maxBatchWriteItems, len(requests))
+		writeBatch(ctx, svc, table, requests[start:end])
+	}
+}
+
+func writeBatch(ctx context.Context, svc *dynamodb.DynamoDB, table string, requests []*dynamodb.WriteRequest) {
+	maxRetries := getEnvInt("DYNAMODB_BATCH_MAX_RETRIES", 5)
+	pending := requests
+
+	var err error
+	for attempt := 0; attempt <= maxRetries && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			delay := backoffDelay(50*time.Millisecond, attempt)
+			loggerFrom(ctx).Info("Retrying unprocessed items", "stage", "record", "table", table, "items", len(pending), "delay", delay.String(), "attempt", attempt)
+			if err = sleepContext(ctx, delay); err != nil {
+				break
+			}
+		}
+
+		dctx, cancel := dynamoContext(ctx)
+		var out *dynamodb.BatchWriteItemOutput
+		out, err = svc.BatchWriteItemWithContext(dctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{table: pending},
+		})
+		cancel()
+		if err != nil {
+			break
+		}
+		pending = out.UnprocessedItems[table]
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+	for _, r := range pending {
+		loggerFrom(ctx).Error("Item not persisted by BatchWriteItem", "stage", "record", "table", table,
+			"submission_id", itemString(r.PutRequest.Item, "SubmissionId"),
+			"key", itemString(r.PutRequest.Item, "RecordId"),
+			"message_id", itemString(r.PutRequest.Item, "MessageId"),
+			"error", err)
+	}
+}
+
+var ErrInvalidGCPCredentials = errors.New("Invalid GCP credentials")
+
+var (
+	gcpCredsOnce sync.Once
+	gcpCredsOpt  option.ClientOption
+	gcpCredsErr  error
+)
+
+// gcpCredentials parses GCP_CREDS_JSON once per container and returns it as a
+// client option. Unlike a storage client failure, a parse failure is cached:
+// the variable cannot change without a new container.
+func gcpCredentials() (option.ClientOption, error) {
+	gcpCredsOnce.Do(func() {
+		creds, err := google.CredentialsFromJSON(context.Background(), []byte(os.Getenv("GCP_CREDS_JSON")), storage.ScopeFullControl)
+		if err != nil {
+			gcpCredsErr = fmt.Errorf("%w in GCP_CREDS_JSON: %v", ErrInvalidGCPCredentials, err)
+			return
+		}
+		gcpCredsOpt = option.WithCredentials(creds)
+	})
+	return gcpCredsOpt, gcpCredsErr
+}
+
+var (
+	storageMu     sync.Mutex
+	storageOnce   sync.Once
+	storageClient *storage.Client
+	storageErr    error
+)
+
+// getStorageClient lazily creates the GCS client once per container so warm
+// invocations reuse its credentials and connections. A failed initialisation
+// is not cached; the next call tries again.
+func getStorageClient() (*storage.Client, error) {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+
+	storageOnce.Do(func() {
+		creds, err := gcpCredentials()
+		if err != nil {
+			storageErr = err
+			return
+		}
+		storageClient, storageErr = storage.NewClient(context.Background(), creds)
+	})
+	if storageErr != nil {
+		err := storageErr
+		storageOnce = sync.Once{}
+		storageClient, storageErr = nil, nil
+		return nil, err
+	}
+
+	return storageClient, nil
+}
+
+// CloseStorageClient closes the shared GCS client, e.g. when the runtime is
+// shutting down.
+func CloseStorageClient() {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+
+	if storageClient == nil {
+		return
+	}
+	if err := storageClient.Close(); err != nil {
+		logger.Error("Error closing client", "error", err)
+	}
+	storageClient = nil
+	storageOnce = sync.Once{}
+}
+
+var ErrObjectExists = errors.New("Object already exists")
+
+var ErrInvalidObjectKey = errors.New("Invalid object key")
+
+// maxObjectKeyBytes is the GCS limit on object name length.
+const maxObjectKeyBytes = 1024
+
+// ValidateObjectKey checks key against the GCS object naming rules: valid
+// UTF-8 of 1-1024 bytes, no carriage returns or line feeds, no leading "."
+// and no reserved ".well-known/acme-challenge/" prefix.
+func ValidateObjectKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: empty", ErrInvalidObjectKey)
+	case len(key) > maxObjectKeyBytes:
+		return fmt.Errorf("%w: %d bytes exceeds the %d byte limit", ErrInvalidObjectKey, len(key), maxObjectKeyBytes)
+	case !utf8.ValidString(key):
+		return fmt.Errorf("%w: not valid UTF-8", ErrInvalidObjectKey)
+	case strings.ContainsAny(key, "\r\n"):
+		return fmt.Errorf("%w: contains a carriage return or line feed", ErrInvalidObjectKey)
+	case strings.HasPrefix(key, "."):
+		return fmt.Errorf("%w: starts with \".\"", ErrInvalidObjectKey)
+	case strings.HasPrefix(key, ".well-known/acme-challenge/"):
+		return fmt.Errorf("%w: reserved prefix", ErrInvalidObjectKey)
+	}
+	return nil
+}
+
+// OVERWRITE_POLICY values. "overwrite" replaces an existing object, "reject"
+// fails the upload if the key is taken and "version" appends a timestamp to
+// the key so earlier submissions are kept.
+const (
+	OverwriteAllow   = "overwrite"
+	OverwriteReject  = "reject"
+	OverwriteVersion = "version"
+)
+
+// ObjectACLNone is the OBJECT_ACL value that sends no predefined ACL, for
+// buckets with uniform bucket-level access, which refuse one.
+const ObjectACLNone = "none"
+
+// gcsPredefinedACLs are GCS's predefined object ACLs, the other values
+// OBJECT_ACL takes.
+var gcsPredefinedACLs = []string{"authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead", "private", "projectPrivate", "publicRead"}
+
+func validObjectACL(acl string) bool {
+	return acl == ObjectACLNone || slices.Contains(gcsPredefinedACLs, acl)
+}
+
+// objectACL returns OBJECT_ACL, the predefined ACL GCS uploads are written
+// with, private by default.
+func objectACL() string {
+	acl := os.Getenv("OBJECT_ACL")
+	if acl == "" {
+		return "private"
+	}
+	if !validObjectACL(acl) {
+		logger.Warn("Unknown OBJECT_ACL, keeping the object private", "acl", acl)
+		return "private"
+	}
+	return acl
+}
+
+func overwritePolicy() string {
+	switch p := os.Getenv("OVERWRITE_POLICY"); p {
+	case "":
+		return OverwriteAllow
+	case OverwriteAllow, OverwriteReject, OverwriteVersion:
+		return p
+	default:
+		logger.Warn("Unknown OVERWRITE_POLICY, refusing to overwrite", "policy", p)
+		return OverwriteReject
+	}
+}
+
+const defaultObjectKeyTemplate = "{AssignmentId}/{UserId}/{SubmissionId}"
+
+var objectKeyPlaceholder = regexp.MustCompile(`\{([A-Za-z]*)\}`)
+
+// BuildObjectKey expands an OBJECT_KEY_TEMPLATE into the object key for msg.
+// The recognised placeholders are {AssignmentId}, {UserId}, {SubmissionId}
+// and {AssignmentType}; each value is sanitised into a single path segment
+// before substitution. An empty template means defaultObjectKeyTemplate. The
+// key is placed under OBJECT_PREFIX (e.g. "fall2024/cs101/") so several
+// courses can share a bucket.
+func BuildObjectKey(tmpl string, msg Structmsg) (string, error) {
+	if tmpl == "" {
+		tmpl = defaultObjectKeyTemplate
+	}
+
+	values := map[string]string{
+		"AssignmentId":   sanitizeSegment(msg.AssignmentId),
+		"UserId":         sanitizeSegment(msg.UserId),
+		"SubmissionId":   sanitizeSegment(msg.SubmissionId),
+		"AssignmentType": sanitizeSegment(msg.AssignmentType),
+	}
+
+	var unknown []string
+	key := objectKeyPlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		v, ok := values[name]
+		if !ok {
+			unknown = append(unknown, m)
+		}
+		return v
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("object key template has unknown placeholders: %s", strings.Join(unknown, ", "))
+	}
+
+	segments := []string{}
+	for _, seg := range strings.Split(key, "/") {
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("object key template %q produced an empty key", tmpl)
+	}
+
+	return strings.Join(append(objectPrefix(), segments...), "/"), nil
+}
+
+// objectPrefix splits OBJECT_PREFIX into sanitised segments, dropping empty
+// ones so leading, trailing and doubled slashes don't reach the key.
+func objectPrefix() []string {
+	var segments []string
+	for _, seg := range strings.Split(os.Getenv("OBJECT_PREFIX"), "/") {
+		if seg = sanitizeSegment(strings.TrimSpace(seg)); seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
+
+// sanitizeSegment makes s safe to use as one segment of an object key:
+// separators become underscores, non-printable characters are dropped and
+// "." / ".." are neutralised so they can't be read as relative paths.
+func sanitizeSegment(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case !unicode.IsPrint(r):
+			return -1
+		}
+		return r
+	}, s)
+
+	if strings.Trim(s, ".") == "" {
+		return strings.Repeat("_", len(s))
+	}
+
+	return s
+}
+
+const (
+	defaultObjectLabels = "assignment={AssignmentId},submitted-at={SubmittedAt}"
+	maxLabelLength      = 63
+	maxLabels           = 64
+)
+
+// ObjectLabels expands OBJECT_LABELS, a comma-separated list of key=value
+// pairs, into the labels stored on an uploaded object so lifecycle rules and
+// retention tooling can target it. Values may use the {AssignmentId},
+// {UserId}, {SubmissionId} and {AssignmentType} placeholders and
+// {SubmittedAt}, the upload date. Keys and values are sanitised to GCS's label
+// rules rather than rejected; pairs whose value ends up empty are left out.
+// An empty spec means defaultObjectLabels and "-" disables labels.
+func ObjectLabels(spec string, msg Structmsg, submittedAt time.Time) (map[string]string, error) {
+	if spec == "" {
+		spec = defaultObjectLabels
+	}
+	if spec == "-" {
+		return nil, nil
+	}
+
+	values := map[string]string{
+		"AssignmentId":   msg.AssignmentId,
+		"UserId":         msg.UserId,
+		"SubmissionId":   msg.SubmissionId,
+		"AssignmentType": msg.AssignmentType,
+		"SubmittedAt":    submittedAt.UTC().Format("2006-01-02"),
+	}
+
+	labels := map[string]string{}
+	for _, pair := range splitList(spec) {
+		key, tmpl, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("object label %q is not a key=value pair", pair)
+		}
+
+		var unknown []string
+		value := objectKeyPlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+			v, ok := values[m[1:len(m)-1]]
+			if !ok {
+				unknown = append(unknown, m)
+			}
+			return v
+		})
+		if len(unknown) > 0 {
+			return nil, fmt.Errorf("object label %q has unknown placeholders: %s", key, strings.Join(unknown, ", "))
+		}
+
+		key = sanitizeLabel(key)
+		if key == "" {
+			return nil, fmt.Errorf("object label %q has an empty key", pair)
+		}
+		if !unicode.IsLower(rune(key[0])) {
+			key = truncateLabel("l" + key)
+		}
+		if value = sanitizeLabel(value); value != "" && len(labels) < maxLabels {
+			labels[key] = value
+		}
+	}
+
+	return labels, nil
+}
+
+// sanitizeLabel lowercases s and replaces anything but lowercase letters,
+// digits, '-' and '_' with '_', then truncates it to maxLabelLength.
+func sanitizeLabel(s string) string {
+	s = strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.TrimSpace(s))
+	return truncateLabel(s)
+}
+
+func truncateLabel(s string) string {
+	if len(s) > maxLabelLength {
+		return s[:maxLabelLength]
+	}
+	return s
+}
+
+// objectLabels returns the labels for msg, logging and dropping them if
+// OBJECT_LABELS is invalid so the upload itself still goes ahead.
+func objectLabels(ctx context.Context, msg Structmsg) map[string]string {
+	labels, err := ObjectLabels(os.Getenv("OBJECT_LABELS"), msg, clock.Now())
+	if err != nil {
+		loggerFrom(ctx).Warn("Invalid OBJECT_LABELS, uploading without labels", "stage", "upload", "error", err)
+	}
+	return labels
+}
+
+// SignedObjectURL returns a V4 signed GET URL for key in bucket, valid for
+// ttl. Signing uses the service account in GCP_CREDS_JSON.
+func SignedObjectURL(bucket, key string, ttl time.Duration) (string, error) {
+	client, err := getStorageClient()
+	if err != nil {
+		return "", err
+	}
+
+	return client.Bucket(bucket).SignedURL(key, &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  http.MethodGet,
+		Expires: clock.Now().Add(ttl),
+	})
+}
+
+// ClaimSubmission atomically records that submissionId is being processed in
+// IDEMPOTENCY_TABLE (partition key SubmissionId). It returns false if another
+// delivery already claimed it. With no table configured every submission is
+// treated as new.
+func ClaimSubmission(ctx context.Context, submissionId, messageId string) (bool, error) {
+	table := os.Getenv("IDEMPOTENCY_TABLE")
+	if table == "" {
+		return true, nil
+	}
+
+	svc := getDynamoClient()
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	_, err := svc.PutItemWithContext(dctx, &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"SubmissionId": {S: aws.String(submissionId)},
+			"MessageId":    {S: aws.String(messageId)},
+			"ClaimedAt":    {S: aws.String(clock.Now().UTC().Format(time.RFC3339))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(SubmissionId)"),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ReleaseSubmission drops the claim so a redelivery after a retryable failure
+// is processed again.
+func ReleaseSubmission(ctx context.Context, submissionId string) {
+	table := os.Getenv("IDEMPOTENCY_TABLE")
+	if table == "" {
+		return
+	}
+
+	svc := getDynamoClient()
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	_, err := svc.DeleteItemWithContext(dctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"SubmissionId": {S: aws.String(submissionId)},
+		},
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("Error releasing submission claim", "stage", "idempotency", "error", err)
+	}
+}
+
+// MailToken is the deterministic token of the notification telling the
+// student about one outcome of a submission. A retry that reaches the same
+// outcome gets the same token; a different outcome gets a new one.
+func MailToken(submissionId string, status MailStatus) string {
+	sum := sha256.Sum256([]byte(submissionId + "\x00" + string(status)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// mailTokenKey is the IDEMPOTENCY_TABLE key a mail token is stored under. The
+// prefix keeps it apart from submission claims.
+func mailTokenKey(token string) string {
+	return "mail#" + token
+}
+
+// ClaimMailToken records in IDEMPOTENCY_TABLE that the notification with
+// token is being sent. It returns false if it was already sent, or is being
+// sent by another delivery. A claim that was never settled, e.g. because the
+// invocation timed out mid-send, can be taken over after
+// MAIL_TOKEN_STALE_SECONDS (default 900, the longest a Lambda can run).
+func ClaimMailToken(ctx context.Context, token, submissionId string) (bool, error) {
+	table := os.Getenv("IDEMPOTENCY_TABLE")
+	if table == "" {
+		return true, nil
+	}
+
+	svc := getDynamoClient()
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	now := clock.Now().UTC()
+	stale := now.Add(-time.Duration(getEnvInt("MAIL_TOKEN_STALE_SECONDS", 900)) * time.Second)
+	_, err := svc.PutItemWithContext(dctx, &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"SubmissionId": {S: aws.String(mailTokenKey(token))},
+			"MailFor":      {S: aws.String(submissionId)},
+			"Sent":         {BOOL: aws.Bool(false)},
+			"ClaimedAt":    {S: aws.String(now.Format(time.RFC3339))},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(SubmissionId) OR (#sent = :false AND #at < :stale)"),
+		ExpressionAttributeNames: map[string]*string{"#sent": aws.String("Sent"), "#at": aws.String("ClaimedAt")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":false": {BOOL: aws.Bool(false)},
+			":stale": {S: aws.String(stale.Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SettleMailToken marks a claimed token as sent, or drops it when the send
+// failed so the retry of the record can mail the student.
+func SettleMailToken(ctx context.Context, token string, sent bool) {
+	table := os.Getenv("IDEMPOTENCY_TABLE")
+	if table == "" {
+		return
+	}
+
+	svc := getDynamoClient()
+
+	dctx, cancel := dynamoContext(ctx)
+	defer cancel()
+
+	key := map[string]*dynamodb.AttributeValue{
+		"SubmissionId": {S: aws.String(mailTokenKey(token))},
+	}
+	var err error
+	if sent {
+		_, err = svc.UpdateItemWithContext(dctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(table),
+			Key:                       key,
+			UpdateExpression:          aws.String("SET #sent = :true"),
+			ExpressionAttributeNames:  map[string]*string{"#sent": aws.String("Sent")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":true": {BOOL: aws.Bool(true)}},
+		})
+	} else {
+		_, err = svc.DeleteItemWithContext(dctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(table),
+			Key:       key,
+		})
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Error settling mail token", "stage", "mail", "mail_token", token, "sent", sent, "error", err)
+	}
+}
+
+var ErrUploadRetriesExhausted = errors.New("Upload retries exhausted")
+
+var ErrInsufficientTime = errors.New("Insufficient time, will retry")
+
+// remainingMillis is how long the invocation has left, from the deadline the
+// Lambda runtime puts on the context, or -1 when there is none.
+func remainingMillis(ctx context.Context) int64 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return -1
+	}
+	return time.Until(deadline).Milliseconds()
+}
+
+// checkRemainingTime fails with ErrInsufficientTime when less than
+// UPLOAD_MIN_REMAINING_MS (default 15s) is left of the invocation, so an
+// upload that cannot finish is not started.
+func checkRemainingTime(ctx context.Context) error {
+	remaining := remainingMillis(ctx)
+	if need := int64(getEnvInt("UPLOAD_MIN_REMAINING_MS", 15000)); remaining >= 0 && remaining < need {
+		return fmt.Errorf("%w: %dms left of the invocation, need %dms", ErrInsufficientTime, remaining, need)
+	}
+	return nil
+}
+
+// withTransferDeadline bounds the download and upload to end
+// LAMBDA_TIME_MARGIN_MS (default 5s) before the invocation does, leaving
+// time to record and mail a transfer that was cut off.
+func withTransferDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	margin := time.Duration(getEnvInt("LAMBDA_TIME_MARGIN_MS", 5000)) * time.Millisecond
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// UploadToBucket streams r into the bucket object. If reading r fails the
+// write is cancelled so no partial object is left behind.
+//
+// Transient GCS errors (429, 5xx, network failures) are retried up to
+// GCS_UPLOAD_MAX_RETRIES times with exponential backoff starting at
+// GCS_UPLOAD_BACKOFF_MS. The client buffers each chunk of the resumable upload,
+// so a retry resends the failed chunk rather than re-reading r, and the object
+// only appears once the upload is finalised, so a failed attempt never leaves
+// a partial object. With DoesNotExist as the precondition under the reject and
+// version policies, a retry can also never replace another upload. The
+// client is the shared one from getStorageClient and stays open; the writer
+// is always closed, and on any error it is cancelled first so the resumable
+// upload is abandoned rather than finalised.
+func UploadToBucket(ctx context.Context, submissionId string, msg Structmsg, r io.Reader) error {
+	if err := ValidateObjectKey(submissionId); err != nil {
+		loggerFrom(ctx).Error("Refusing to upload with invalid key", "stage", "upload", "error", err)
+		return err
+	}
+
+	client, err := getStorageClient()
+	if err != nil {
+		loggerFrom(ctx).Error("Error creating client", "stage", "upload", "error", err)
+		return err
+	}
+
+	maxRetries := getEnvInt("GCS_UPLOAD_MAX_RETRIES", 3)
+	attempts, exhausted := 0, false
+	retryer := []storage.RetryOption{
+		storage.WithPolicy(storage.RetryAlways),
+		storage.WithBackoff(gax.Backoff{
+			Initial:    time.Duration(getEnvInt("GCS_UPLOAD_BACKOFF_MS", 500)) * time.Millisecond,
+			Max:        30 * time.Second,
+			Multiplier: 2,
+		}),
+		storage.WithErrorFunc(func(err error) bool {
+			if !storage.ShouldRetry(err) {
+				return false
+			}
+			attempts++
+			if attempts > maxRetries {
+				exhausted = true
+				return false
+			}
+			loggerFrom(ctx).Warn("Retrying upload", "stage", "upload", "attempt", attempts, "max_retries", maxRetries, "error", err)
+			return true
+		}),
+	}
+
+	bkt := client.Bucket(bucketFrom(ctx))
+	obj := bkt.Object(submissionId).Retryer(retryer...)
+	if overwritePolicy() != OverwriteAllow {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := obj.NewWriter(ctx)
+	// Cancelling before Close makes Close abort the upload. This also runs
+	// if r panics, which would otherwise leave the writer's goroutine behind.
+	closed := false
+	defer func() {
+		if !closed {
+			cancel()
+			w.Close()
+		}
+	}()
+	w.ContentType = "application/zip"
+	w.CacheControl = "private, max-age=0"
+	if acl := objectACL(); acl != ObjectACLNone {
+		w.PredefinedACL = acl
+	}
+	w.Metadata = map[string]string{
+		"AssignmentId": msg.AssignmentId,
+		"UserId":       msg.UserId,
+		"SubmissionId": msg.SubmissionId,
+	}
+	// GCS objects have no labels of their own, so they go in the metadata;
+	// lifecycle rules can match on CustomTime via daysSinceCustomTime.
+	for k, v := range objectLabels(ctx, msg) {
+		w.Metadata[k] = v
+	}
+	w.CustomTime = clock.Now().UTC()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		loggerFrom(ctx).Error("Error writing content", "stage", "upload", "error", err, "bytes_written", n)
+		if exhausted {
+			return fmt.Errorf("%w after %d attempts: %w", ErrUploadRetriesExhausted, attempts, err)
+		}
+		return err
+	}
+
+	closed = true
+	err = w.Close()
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+		return fmt.Errorf("%w: %s", ErrObjectExists, submissionId)
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Error closing writer", "stage", "upload", "error", err)
+		if exhausted {
+			return fmt.Errorf("%w after %d attempts: %w", ErrUploadRetriesExhausted, attempts, err)
+		}
+		return err
+	}
+
+	// Object metadata is fixed when the upload starts, before the digest is
+	// known, so it is added afterwards. The object is already stored, so a
+	// failure here is only logged.
+	if cs, ok := r.(checksummer); ok {
+		metadata := map[string]string{"sha256": cs.SHA256()}
+		for k, v := range w.Metadata {
+			metadata[k] = v
+		}
+		_, uerr := bkt.Object(submissionId).If(storage.Conditions{GenerationMatch: w.Attrs().Generation}).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+		if uerr != nil {
+			loggerFrom(ctx).Warn("Error storing checksum metadata", "stage", "upload", "error", uerr)
+		}
+	}
+
+	return nil
+}
+
+// STORAGE_BACKEND values selecting where submissions are uploaded. Both use
+// BUCKET as the bucket name, unless a message's TargetBucket overrides it.
+const (
+	BackendGCS = "gcs"
+	BackendS3  = "s3"
+)
+
+func storageBackend() string {
+	if b := os.Getenv("STORAGE_BACKEND"); b != "" {
+		return b
+	}
+	return BackendGCS
+}
+
+// ObjectURI returns the gs:// or s3:// URI of key in bucket for the active
+// storage backend.
+func ObjectURI(bucket, key string) string {
+	scheme := "gs"
+	if storageBackend() == BackendS3 {
+		scheme = "s3"
+	}
+	return scheme + "://" + bucket + "/" + key
+}
+
+const defaultPathDisplayTemplate = "{Scheme}://{Bucket}/{Key}"
+
+// DisplayPath renders the stored location shown to students from
+// PATH_DISPLAY_TEMPLATE, which may use {Scheme} (gs or s3), {Bucket}, {Key}
+// and {SignedUrl}, e.g. https://portal.example.edu/submissions/{Key}. The
+// default is the bucket URI.
+func DisplayPath(tmpl, bucket, key, signedURL string) (string, error) {
+	if tmpl == "" {
+		tmpl = defaultPathDisplayTemplate
+	}
+
+	scheme := "gs"
+	if storageBackend() == BackendS3 {
+		scheme = "s3"
+	}
+	values := map[string]string{
+		"Scheme":    scheme,
+		"Bucket":    bucket,
+		"Key":       key,
+		"SignedUrl": signedURL,
+	}
+
+	var unknown []string
+	path := objectKeyPlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		v, ok := values[m[1:len(m)-1]]
+		if !ok {
+			unknown = append(unknown, m)
+		}
+		return v
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("path display template has unknown placeholders: %s", strings.Join(unknown, ", "))
+	}
+	return path, nil
+}
+
+// displayPath is DisplayPath for the mail. A template using {SignedUrl} when
+// signing failed, or one that does not render, falls back to the bucket URI.
+func displayPath(bucket, key, signedURL string) string {
+	tmpl := os.Getenv("PATH_DISPLAY_TEMPLATE")
+	if signedURL == "" && strings.Contains(tmpl, "{SignedUrl}") {
+		return ObjectURI(bucket, key)
+	}
+
+	path, err := DisplayPath(tmpl, bucket, key, signedURL)
+	if err != nil {
+		logger.Warn("Error rendering PATH_DISPLAY_TEMPLATE, using the bucket path", "error", err)
+		return ObjectURI(bucket, key)
+	}
+	return path
+}
+
+// storageName is the provider name used in mail wording.
+func storageName() string {
+	if storageBackend() == BackendS3 {
+		return "S3"
+	}
+	return "GCP"
+}
+
+var (
+	s3Once   sync.Once
+	s3Client *s3.S3
+)
+
+func getS3Client() *s3.S3 {
+	s3Once.Do(func() {
+		s3Client = s3.New(getAWSSession())
+		xray.AWS(s3Client.Client)
+	})
+	return s3Client
+}
+
+var (
+	snsOnce   sync.Once
+	snsClient *sns.SNS
+)
+
+func getSNSClient() *sns.SNS {
+	snsOnce.Do(func() {
+		snsClient = sns.New(getAWSSession())
+		xray.AWS(snsClient.Client)
+	})
+	return snsClient
+}
+
+var (
+	sesOnce   sync.Once
+	sesClient *ses.SES
+)
+
+func getSESClient() *ses.SES {
+	sesOnce.Do(func() {
+		sesClient = ses.New(getAWSSession())
+		xray.AWS(sesClient.Client)
+	})
+	return sesClient
+}
+
+type snsAlerter struct{}
+
+func (snsAlerter) Alert(ctx context.Context, event FailureEvent) error {
+	return PublishFailure(ctx, event)
+}
+
+// PublishFailure publishes event as JSON to FAILURE_TOPIC_ARN. Stage and
+// Reason are also sent as message attributes so subscriptions can filter on
+// them.
+func PublishFailure(ctx context.Context, event FailureEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, time.Duration(getEnvInt("FAILURE_TOPIC_TIMEOUT_MS", 5000))*time.Millisecond)
+	defer cancel()
+
+	_, err = getSNSClient().PublishWithContext(pctx, &sns.PublishInput{
+		TopicArn: aws.String(os.Getenv("FAILURE_TOPIC_ARN")),
+		Message:  aws.String(string(b)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"stage":  {DataType: aws.String("String"), StringValue: aws.String(event.Stage)},
+			"reason": {DataType: aws.String("String"), StringValue: aws.String(event.Reason)},
+		},
+	})
+	return err
+}
+
+type s3Archiver struct{}
+
+func (s3Archiver) Archive(ctx context.Context, key string, data []byte) error {
+	return ArchiveEvent(ctx, key, data)
+}
+
+// ArchiveKey is the ARCHIVE_BUCKET key for a raw record:
+// events/<SubmissionId>/<time>-<MessageId>.json, so the records for a
+// submission list in the order they arrived. A message without a usable
+// SubmissionId is filed under _unknown.
+func ArchiveKey(submissionId, messageId string, at time.Time) string {
+	dir := sanitizeSegment(submissionId)
+	if dir == "" {
+		dir = "_unknown"
+	}
+	return "events/" + dir + "/" + at.UTC().Format(recordIdTimeLayout) + "-" + sanitizeSegment(messageId) + ".json"
+}
+
+// ArchiveEvent writes the raw SNS record JSON to ARCHIVE_BUCKET on S3,
+// giving up after ARCHIVE_TIMEOUT_MS.
+func ArchiveEvent(ctx context.Context, key string, data []byte) error {
+	actx, cancel := context.WithTimeout(ctx, time.Duration(getEnvInt("ARCHIVE_TIMEOUT_MS", 5000))*time.Millisecond)
+	defer cancel()
+
+	_, err := getS3Client().PutObjectWithContext(actx, &s3.PutObjectInput{
+		Bucket:      aws.String(os.Getenv("ARCHIVE_BUCKET")),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// UploadToS3 streams r into the record's bucket on S3 as a multipart upload. S3 has no
+// create-only write, so unless OVERWRITE_POLICY is overwrite an existing key
+// is detected with a HeadObject first; unlike the GCS precondition this does
+// not stop two concurrent uploads of the same key.
+func UploadToS3(ctx context.Context, key string, msg Structmsg, r io.Reader) error {
+	if err := ValidateObjectKey(key); err != nil {
+		loggerFrom(ctx).Error("Refusing to upload with invalid key", "stage", "upload", "error", err)
+		return err
+	}
+
+	bucket := bucketFrom(ctx)
+	svc := getS3Client()
+
+	if overwritePolicy() != OverwriteAllow {
+		_, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err == nil {
+			return fmt.Errorf("%w: %s", ErrObjectExists, key)
+		}
+		var rerr awserr.RequestFailure
+		if !errors.As(err, &rerr) || rerr.StatusCode() != http.StatusNotFound {
+			loggerFrom(ctx).Error("Error checking for existing object", "stage", "upload", "error", err)
+			return err
+		}
+	}
+
+	body := &errRecordingReader{r: r}
+	_, err := s3manager.NewUploaderWithClient(svc).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         body,
+		ContentType:  aws.String("application/zip"),
+		CacheControl: aws.String("private, max-age=0"),
+		Metadata: aws.StringMap(map[string]string{
+			"AssignmentId": msg.AssignmentId,
+			"UserId":       msg.UserId,
+			"SubmissionId": msg.SubmissionId,
+		}),
+		Tagging: s3Tagging(ctx, objectLabels(ctx, msg)),
+	})
+	// The SDK wraps read failures in its own error type, which hides
+	// ErrFileTooLarge from errors.Is, so report the read error itself.
+	if body.err != nil {
+		err = body.err
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Error uploading to S3", "stage", "upload", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// maxS3Tags is the most tags S3 accepts on one object.
+const maxS3Tags = 10
+
+// s3Tagging encodes labels as S3 object tags, which lifecycle rules can
+// filter on. Setting them needs the s3:PutObjectTagging permission. S3 refuses
+// an object with more than maxS3Tags tags, so only the first ones by key are
+// kept and the rest are logged and dropped.
+func s3Tagging(ctx context.Context, labels map[string]string) *string {
+	if len(labels) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) > maxS3Tags {
+		loggerFrom(ctx).Warn("Too many object labels for S3 tags, dropping the rest", "stage", "upload", "max", maxS3Tags, "dropped", keys[maxS3Tags:])
+		keys = keys[:maxS3Tags]
+	}
+
+	tags := url.Values{}
+	for _, k := range keys {
+		tags.Set(k, labels[k])
+	}
+	return aws.String(tags.Encode())
+}
+
+// SignedS3URL returns a presigned GET URL for key in bucket, valid for ttl.
+func SignedS3URL(bucket, key string, ttl time.Duration) (string, error) {
+	req, _ := getS3Client().GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
+}
+
+// errRecordingReader remembers the first non-EOF error returned by r.
+type errRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errRecordingReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+var ErrFileTooLarge = errors.New("File too large")
+
+// ErrFileTooSmall is returned for a submission below MIN_DOWNLOAD_BYTES,
+// which is almost always an empty or truncated file rather than real work.
+var ErrFileTooSmall = errors.New("File too small")
+
+var ErrTooManyRedirects = errors.New("Too many redirects")
+
+var ErrUnreachable = errors.New("Submission URL not reachable")
+
+var ErrCorruptZip = errors.New("Corrupt zip file")
+
+var ErrNotZip = errors.New("Not a zip file")
+
+var ErrBlockedHost = errors.New("Blocked host")
+
+var downloadClient = newDownloadClient()
+
+// newDownloadClient returns the client for submission downloads. It has no
+// overall Timeout: that would also cover reading the body, which is streamed
+// into the upload, and so cut off large uploads on slow links. Connecting and
+// waiting for the response headers are bounded by DOWNLOAD_TIMEOUT_SECONDS in
+// the transport, and the whole transfer by withTransferDeadline.
+func newDownloadClient() *http.Client {
+	maxRedirects := getEnvInt("DOWNLOAD_MAX_REDIRECTS", 5)
+	return &http.Client{
+		Transport: tracingTransport{base: newDownloadTransport()},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Recorded before the checks, so a refused redirect still shows
+			// where it was going.
+			if info, _ := req.Context().Value(downloadInfoKey{}).(*DownloadInfo); info != nil {
+				info.FinalUrl = req.URL.String()
+			}
+			if len(via) > maxRedirects {
+				return fmt.Errorf("%w: stopped after %d", ErrTooManyRedirects, maxRedirects)
+			}
+			return checkDownloadHost(req.URL.Hostname())
+		},
+	}
+}
+
+// newDownloadTransport returns a transport that checks every address it
+// connects to with checkDownloadIP. The check runs on the resolved address,
+// so it also covers redirects and DNS names that point at internal hosts.
+// There is no proxy, as the check would then only see the proxy's address.
+func newDownloadTransport() *http.Transport {
+	timeout := time.Duration(getEnvInt("DOWNLOAD_TIMEOUT_SECONDS", 30)) * time.Second
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("%w: unresolved address %s", ErrBlockedHost, address)
+			}
+			return checkDownloadIP(ip)
+		},
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+	t.ResponseHeaderTimeout = timeout
+	// CheckConfig has already rejected a bad bundle at start; should one get
+	// here anyway, downloads keep the default verification.
+	if cfg, err := downloadTLSConfig(); err != nil {
+		logger.Error("Invalid download TLS settings, using the default trust store", "error", err)
+	} else if cfg != nil {
+		t.TLSClientConfig = cfg
+	}
+	return t
+}
+
+// downloadTLSConfig returns the TLS settings for submission downloads, or nil
+// for the defaults. DOWNLOAD_CA_BUNDLE adds CAs to the system trust store, for
+// submission servers with an internal CA; it is either PEM itself or the path
+// of a PEM file. DOWNLOAD_TLS_INSECURE_SKIP_VERIFY=true turns certificate
+// verification off entirely, which lets anyone on the path serve or read the
+// file, so it is only for test environments.
+func downloadTLSConfig() (*tls.Config, error) {
+	bundle := strings.TrimSpace(os.Getenv("DOWNLOAD_CA_BUNDLE"))
+	insecure := os.Getenv("DOWNLOAD_TLS_INSECURE_SKIP_VERIFY") == "true"
+	if bundle == "" && !insecure {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if insecure {
+		logger.Warn("TLS verification of submission downloads is disabled by DOWNLOAD_TLS_INSECURE_SKIP_VERIFY")
+		cfg.InsecureSkipVerify = true
+	}
+	if bundle == "" {
+		return cfg, nil
+	}
+
+	data := []byte(bundle)
+	if !strings.HasPrefix(bundle, "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(bundle); err != nil {
+			return nil, fmt.Errorf("reading DOWNLOAD_CA_BUNDLE: %w", err)
+		}
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("DOWNLOAD_CA_BUNDLE contains no PEM certificates")
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// checkDownloadHost enforces ALLOWED_DOWNLOAD_HOSTS. An entry matches the host
+// exactly, or any subdomain of it when it starts with "."; an empty list
+// allows every host.
+func checkDownloadHost(host string) error {
+	allowed := splitList(os.Getenv("ALLOWED_DOWNLOAD_HOSTS"))
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	if hostMatches(host, allowed) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not in ALLOWED_DOWNLOAD_HOSTS", ErrBlockedHost, host)
+}
+
+// hostMatches reports whether host equals one of entries, or is a subdomain
+// of an entry starting with ".".
+func hostMatches(host string, entries []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range entries {
+		entry = strings.ToLower(entry)
+		if host == entry || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// setDownloadAuth adds DOWNLOAD_AUTH_HEADER as the Authorization header, e.g.
+// "Bearer <token>" or "Basic <base64>". Submission URLs come from students, so
+// the credential is only sent to hosts listed in DOWNLOAD_AUTH_HOSTS; the HTTP
+// client also drops it on redirects to another domain. It is never logged.
+func setDownloadAuth(req *http.Request) {
+	auth := os.Getenv("DOWNLOAD_AUTH_HEADER")
+	if auth == "" || !hostMatches(req.URL.Hostname(), splitList(os.Getenv("DOWNLOAD_AUTH_HOSTS"))) {
+		return
+	}
+	req.Header.Set("Authorization", auth)
+}
+
+// checkDownloadIP rejects loopback, private, link-local, multicast and
+// unspecified addresses, plus anything in BLOCKED_CIDRS. Setting
+// DOWNLOAD_ALLOW_PRIVATE=true lifts the built-in ranges, e.g. for local
+// testing, but BLOCKED_CIDRS still applies.
+func checkDownloadIP(ip net.IP) error {
+	if os.Getenv("DOWNLOAD_ALLOW_PRIVATE") != "true" &&
+		(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+			ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()) {
+		return fmt.Errorf("%w: %s is not a public address", ErrBlockedHost, ip)
+	}
+
+	cidrs, _ := blockedCIDRs()
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return fmt.Errorf("%w: %s is in %s", ErrBlockedHost, ip, cidr)
+		}
+	}
+	return nil
+}
+
+// blockedCIDRs parses BLOCKED_CIDRS. CheckConfig reports invalid entries at
+// startup; later callers only see the valid ones.
+func blockedCIDRs() ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	var errs []error
+	for _, entry := range splitList(os.Getenv("BLOCKED_CIDRS")) {
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, errors.Join(errs...)
+}
+
+// tracingEnabled reports whether the invocation carries an X-Ray trace
+// header. Outside Lambda there is none and tracing is a no-op.
+func tracingEnabled() bool {
+	return os.Getenv("_X_AMZN_TRACE_ID") != ""
+}
+
+// traceCapture runs fn inside an X-Ray subsegment called name when tracing
+// is enabled.
+func traceCapture(ctx context.Context, name string, fn func(context.Context) error) error {
+	if !tracingEnabled() {
+		return fn(ctx)
+	}
+	return xray.Capture(ctx, name, fn)
+}
+
+// tracingTransport records each request as an X-Ray subsegment when tracing
+// is enabled, and otherwise calls base directly.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !tracingEnabled() {
+		return t.base.RoundTrip(req)
+	}
+	return xray.RoundTripper(t.base).RoundTrip(req)
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// Download fetches the submission and returns its body as a stream. The
+// response headers are checked up front; the size limit is enforced while the
+// caller reads, so a body that turns out too large fails with ErrFileTooLarge.
+func Download(ctx context.Context, url string) (io.ReadCloser, error) {
+	maxRetries := retryBudget(ctx, getEnvInt("DOWNLOAD_MAX_RETRIES", 3))
+	backoff := time.Duration(getEnvInt("DOWNLOAD_BACKOFF_MS", 500)) * time.Millisecond
+
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := backoffDelay(backoff, attempt)
+			loggerFrom(ctx).Info("Retrying download", "stage", "download", "delay", delay.String(), "attempt", attempt, "max_retries", maxRetries)
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+
+		if info, _ := ctx.Value(downloadInfoKey{}).(*DownloadInfo); info != nil {
+			info.Retries = attempt
+		}
+		var body io.ReadCloser
+		body, err = downloadOnce(ctx, url)
+		if err == nil {
+			return body, nil
+		}
+
+		var rerr *retryableError
+		if !errors.As(err, &rerr) {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// DownloadInfo describes the last response the server sent for a download,
+// after redirects, whether or not the download succeeded. FinalUrl is also
+// set for a redirect that was refused.
+type DownloadInfo struct {
+	StatusCode  int
+	FinalUrl    string
+	ContentType string
+	// ContentLength is the declared size, or -1 when the server gave none.
+	ContentLength int64
+	// Retries is the number of attempts Download made after the first.
+	Retries int
+}
+
+type downloadInfoKey struct{}
+
+// withDownloadInfo returns a context under which Download records what the
+// server returned into the returned DownloadInfo.
+func withDownloadInfo(ctx context.Context) (context.Context, *DownloadInfo) {
+	info := &DownloadInfo{}
+	return context.WithValue(ctx, downloadInfoKey{}, info), info
+}
+
+func downloadOnce(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		loggerFrom(ctx).Error("Error building request", "stage", "download", "error", err)
+		return nil, err
+	}
+	// Asking for an encoding explicitly stops the transport from decoding
+	// gzip on its own, so every encoding goes through decodeBody below.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	setDownloadAuth(req)
+
+	if err := checkDownloadHost(req.URL.Hostname()); err != nil {
+		loggerFrom(ctx).Warn("Refusing to download from host", "stage", "download", "error", err)
+		return nil, err
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrTooManyRedirects) || errors.Is(err, ErrBlockedHost) {
+			loggerFrom(ctx).Error("Error fetching URL", "stage", "download", "error", err)
+			return nil, err
+		}
+		loggerFrom(ctx).Warn("Error fetching URL", "stage", "download", "error", err)
+		return nil, &retryableError{err}
+	}
+
+	if info, _ := ctx.Value(downloadInfoKey{}).(*DownloadInfo); info != nil {
+		info.StatusCode = resp.StatusCode
+		info.FinalUrl = resp.Request.URL.String()
+		info.ContentType = resp.Header.Get("Content-Type")
+		info.ContentLength = resp.ContentLength
+	}
+
+	ok := false
+	defer func() {
+		if !ok {
+			resp.Body.Close()
+		}
+	}()
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		loggerFrom(ctx).Warn("Server returned retryable status", "stage", "download", "status", resp.StatusCode)
+		return nil, &retryableError{fmt.Errorf("server returned status %d", resp.StatusCode)}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		loggerFrom(ctx).Warn("Submission URL returned unexpected status", "stage", "download", "status", resp.StatusCode)
+		return nil, fmt.Errorf("%w: status %s", ErrUnreachable, resp.Status)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	sniff := false
+	if !isAllowedContentType(contentType) {
+		if !isAmbiguousContentType(contentType) {
+			loggerFrom(ctx).Warn("Zip file not provided", "stage", "download", "content_type", contentType)
+			return nil, fmt.Errorf("%w: server returned Content-Type %q", ErrNotZip, contentType)
+		}
+		sniff = true
+	}
+
+	maxBytes := int64(getEnvInt("MAX_DOWNLOAD_BYTES", 50*1024*1024))
+	// Content-Length is the encoded size, so it only bounds the file when the
+	// body is not compressed; the decoded stream is capped either way.
+	if resp.Header.Get("Content-Encoding") == "" && resp.ContentLength > maxBytes {
+		loggerFrom(ctx).Warn("Content length exceeds limit", "stage", "download", "content_length", resp.ContentLength, "limit", maxBytes)
+		return nil, ErrFileTooLarge
+	}
+
+	minBytes := minDownloadBytes()
+	if resp.Header.Get("Content-Encoding") == "" && resp.ContentLength >= 0 && resp.ContentLength < int64(minBytes) {
+		loggerFrom(ctx).Warn("Content length below minimum", "stage", "download", "content_length", resp.ContentLength, "minimum", minBytes)
+		return nil, fmt.Errorf("%w: %d bytes, the minimum is %d", ErrFileTooSmall, resp.ContentLength, minBytes)
+	}
+
+	body, err := decodeBody(resp)
+	if errors.Is(err, errUnsupportedEncoding) {
+		loggerFrom(ctx).Warn("Unsupported content encoding", "stage", "download", "content_encoding", resp.Header.Get("Content-Encoding"))
+		return nil, err
+	}
+	if err != nil {
+		loggerFrom(ctx).Warn("Error decoding response body", "stage", "download", "content_encoding", resp.Header.Get("Content-Encoding"), "error", err)
+		return nil, &retryableError{err}
+	}
+
+	br := bufio.NewReaderSize(body, max(4096, minBytes))
+	// Peeking the minimum catches a small body that had no Content-Length,
+	// or was compressed, before any of it reaches the bucket.
+	if minBytes > 0 {
+		head, err := br.Peek(minBytes)
+		if err != nil && err != io.EOF {
+			loggerFrom(ctx).Warn("Error reading response body", "stage", "download", "error", err)
+			return nil, &retryableError{err}
+		}
+		if len(head) < minBytes {
+			loggerFrom(ctx).Warn("Downloaded file below minimum", "stage", "download", "size", len(head), "minimum", minBytes)
+			return nil, fmt.Errorf("%w: %d bytes, the minimum is %d", ErrFileTooSmall, len(head), minBytes)
+		}
+	}
+	if sniff {
+		magic, err := br.Peek(len(zipMagic))
+		if err != nil && err != io.EOF {
+			loggerFrom(ctx).Warn("Error reading response body", "stage", "download", "error", err)
+			return nil, &retryableError{err}
+		}
+		if !bytes.Equal(magic, zipMagic) {
+			loggerFrom(ctx).Warn("Zip file not provided, missing zip signature", "stage", "download", "content_type", contentType)
+			return nil, fmt.Errorf("%w: server returned Content-Type %q without a zip signature", ErrNotZip, contentType)
+		}
+	}
+
+	ok = true
+	return struct {
+		io.Reader
+		io.Closer
+	}{&sizeLimitedReader{r: io.LimitReader(br, maxBytes+1), remaining: maxBytes}, body}, nil
+}
+
+var ErrInvalidSubmissionData = errors.New("SubmissionData is not valid base64")
+
+// InlineSubmission decodes the base64 SubmissionData of a message. It gets
+// the same checks as a download: between MIN_DOWNLOAD_BYTES and
+// MAX_DOWNLOAD_BYTES, and the zip signature must be present.
+func InlineSubmission(data string) (io.ReadCloser, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSubmissionData, err)
+	}
+
+	if maxBytes := getEnvInt("MAX_DOWNLOAD_BYTES", 50*1024*1024); len(b) > maxBytes {
+		return nil, ErrFileTooLarge
+	}
+	if minBytes := minDownloadBytes(); len(b) < minBytes {
+		return nil, fmt.Errorf("%w: %d bytes, the minimum is %d", ErrFileTooSmall, len(b), minBytes)
+	}
+	if !bytes.HasPrefix(b, zipMagic) {
+		return nil, fmt.Errorf("%w: inline data is missing the zip signature", ErrNotZip)
+	}
+
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// minDownloadBytes is MIN_DOWNLOAD_BYTES, 0 to disable the check. The default
+// of 100 is the smallest zip that holds a single entry: a one-character name
+// with no content.
+func minDownloadBytes() int {
+	return max(getEnvInt("MIN_DOWNLOAD_BYTES", 100), 0)
+}
+
+var errUnsupportedEncoding = errors.New("Unsupported content encoding")
+
+// decodeBody returns the response body with any gzip or deflate
+// Content-Encoding removed. Closing the result closes resp.Body.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return decodedBody{zr, resp.Body}, nil
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped, but some servers send a raw
+		// deflate stream, so check for a zlib header first.
+		br := bufio.NewReader(resp.Body)
+		header, _ := br.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			return decodedBody{zr, resp.Body}, nil
+		}
+		return decodedBody{flate.NewReader(br), resp.Body}, nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// decodedBody reads from a decompressor and closes it along with the
+// underlying response body.
+type decodedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (d decodedBody) Close() error {
+	d.ReadCloser.Close()
+	return d.body.Close()
+}
+
+// ValidateZip buffers r and checks that it opens as a zip archive, i.e. its
+// central directory is readable. It returns a reader over the buffered bytes.
+// This holds the whole file in memory, so it is only done when VALIDATE_ZIP is
+// set.
+func ValidateZip(r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if errors.Is(err, ErrFileTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &retryableError{err}
+	}
+
+	if _, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptZip, err)
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// Transform repackages a downloaded submission before it is uploaded. An
+// error wrapping ErrCorruptZip is reported like a corrupt download.
+type Transform interface {
+	Name() string
+	Apply(ctx context.Context, msg Structmsg, r io.Reader) (io.Reader, error)
+}
+
+// transformFor picks the Transform named by TRANSFORM: "none" (or empty)
+// uploads the bytes as downloaded, "add-manifest" adds a manifest file.
+func transformFor(name string) (Transform, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return nil, nil
+	case "add-manifest":
+		return manifestTransform{}, nil
+	default:
+		return nil, fmt.Errorf("unknown TRANSFORM %q, expected none or add-manifest", name)
+	}
+}
+
+// manifestName is the entry the add-manifest transform writes. An entry the
+// student uploaded under the same name is replaced.
+const manifestName = "submission-manifest.json"
+
+// SubmissionManifest records where a submission came from, inside the zip
+// itself, so the archive still explains itself once copied out of the bucket.
+type SubmissionManifest struct {
+	SubmissionId   string `json:"SubmissionId"`
+	AssignmentId   string `json:"AssignmentId"`
+	AssignmentType string `json:"AssignmentType,omitempty"`
+	UserId         string `json:"UserId"`
+	CorrelationId  string `json:"CorrelationId"`
+	// OriginalSHA256 and OriginalSizeBytes describe the zip as downloaded,
+	// before the manifest was added.
+	OriginalSHA256    string    `json:"OriginalSHA256"`
+	OriginalSizeBytes int64     `json:"OriginalSizeBytes"`
+	Files             int       `json:"Files"`
+	PackagedAt        time.Time `json:"PackagedAt"`
+}
+
+type manifestTransform struct{}
+
+func (manifestTransform) Name() string {
+	return "add-manifest"
+}
+
+// Apply rewrites the zip with a manifest entry. The existing entries are
+// copied without being recompressed.
+func (manifestTransform) Apply(ctx context.Context, msg Structmsg, r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if errors.Is(err, ErrFileTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &retryableError{err}
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptZip, err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := 0
+	for _, f := range zr.File {
+		if f.Name == manifestName {
+			continue
+		}
+		if err := zw.Copy(f); err != nil {
+			return nil, fmt.Errorf("%w: copying %s: %v", ErrCorruptZip, f.Name, err)
+		}
+		if !f.FileInfo().IsDir() {
+			files++
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	manifest, err := json.MarshalIndent(SubmissionManifest{
+		SubmissionId:      msg.SubmissionId,
+		AssignmentId:      msg.AssignmentId,
+		AssignmentType:    msg.AssignmentType,
+		UserId:            msg.UserId,
+		CorrelationId:     CorrelationId(ctx),
+		OriginalSHA256:    hex.EncodeToString(sum[:]),
+		OriginalSizeBytes: int64(len(data)),
+		Files:             files,
+		PackagedAt:        clock.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: manifestName, Method: zip.Deflate, Modified: clock.Now()})
+	if err == nil {
+		_, err = w.Write(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+// sizeLimitedReader fails with ErrFileTooLarge once more than remaining bytes
+// have been read from r.
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, ErrFileTooLarge
+	}
+
+	return n, err
+}
+
+var zipMagic = []byte("PK\x03\x04")
+
+var defaultContentTypes = "application/zip,application/x-zip-compressed,application/x-zip"
+
+// mediaType returns the lowercased media type of a Content-Type header
+// without its parameters, so "Application/Zip; charset=binary" is
+// "application/zip". A header that does not parse is cut at the first ';'.
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+func isAllowedContentType(contentType string) bool {
+	allowed := os.Getenv("ALLOWED_CONTENT_TYPES")
+	if allowed == "" {
+		allowed = defaultContentTypes
+	}
+
+	t := mediaType(contentType)
+	for _, a := range strings.Split(allowed, ",") {
+		if m := mediaType(a); m != "" && m == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Content types that servers commonly send for zips they don't recognise.
+// These are only accepted when the body starts with the zip signature.
+func isAmbiguousContentType(contentType string) bool {
+	switch mediaType(contentType) {
+	case "", "application/octet-stream", "binary/octet-stream", "application/binary":
+		return true
+	}
+
+	return false
+}
+
+// backoffDelay returns the exponential delay before the given retry attempt
+// (counting from 1), with up to 50% random jitter added.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base << (attempt - 1)
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Clock is where timestamps, TTLs and durations get the current time from,
+// so tests can fix it.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock Clock = systemClock{}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// Network failures, 5xx/429 responses and cancelled contexts are worth having
+// SNS redeliver; everything else (not a zip, too large) would fail again.
+func isRetryable(err error) bool {
+	var rerr *retryableError
+	return errors.As(err, &rerr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+var logger = newLogger()
+
+// newLogger builds the JSON logger used for every log line. LOG_LEVEL takes
+// the slog level names (DEBUG, INFO, WARN, ERROR) and defaults to INFO.
+func newLogger() *slog.Logger {
+	level := slog.LevelInfo
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			level = slog.LevelInfo
+		}
+	}
+
+	l := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(l)
+	return l
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger carrying the invocation and record fields
+// attached by HandleRequest and ProcessRecord.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+type correlationKey struct{}
+
+// CorrelationId returns the id ProcessRecord assigned to the record being
+// processed. It is taken from the "correlationId" SNS message attribute when
+// the publisher set one, and generated otherwise.
+func CorrelationId(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// snsAttribute returns the string value of a message attribute, which the
+// Lambda SNS event carries as {"Type": ..., "Value": ...}.
+func snsAttribute(entity events.SNSEntity, name string) string {
+	attr, ok := entity.MessageAttributes[name].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	v, _ := attr["Value"].(string)
+	return v
+}
+
+// SNS message attributes the pipeline understands. Any others are ignored.
+const (
+	// attrCorrelationId carries an upstream correlation id.
+	attrCorrelationId = "correlationId"
+	// attrPriority set to "high" doubles the download and mail retry budgets.
+	attrPriority = "priority"
+	// attrAssignmentType overrides Structmsg.AssignmentType, which the object
+	// key template can use as {AssignmentType}.
+	attrAssignmentType = "assignmentType"
+)
+
+// Routing holds the per-record hints taken from SNS message attributes.
+type Routing struct {
+	HighPriority   bool
+	AssignmentType string
+}
+
+type routingKey struct{}
+
+// parseRouting reads the recognised message attributes from entity and
+// returns the names of any it does not recognise.
+func parseRouting(entity events.SNSEntity) (Routing, []string) {
+	routing := Routing{
+		HighPriority:   strings.EqualFold(snsAttribute(entity, attrPriority), "high"),
+		AssignmentType: snsAttribute(entity, attrAssignmentType),
+	}
+
+	var ignored []string
+	for name := range entity.MessageAttributes {
+		switch name {
+		case attrCorrelationId, attrPriority, attrAssignmentType:
+		default:
+			ignored = append(ignored, name)
+		}
+	}
+	sort.Strings(ignored)
+
+	return routing, ignored
+}
+
+func routingFrom(ctx context.Context) Routing {
+	routing, _ := ctx.Value(routingKey{}).(Routing)
+	return routing
+}
+
+// retryBudget returns the configured retry count n, doubled for
+// high-priority records.
+func retryBudget(ctx context.Context, n int) int {
+	if routingFrom(ctx).HighPriority {
+		return n * 2
+	}
+	return n
+}
+
+func requestId(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return lc.AwsRequestID
+	}
+	return ""
+}
+
+// splitList splits a comma-separated env value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		logger.Warn("Invalid environment value, using default", "key", key, "default", def)
+		return def
+	}
+
+	return n
+}
+
+// BodyOptions carries the optional extras shown in a success email.
+type BodyOptions struct {
+	Attached    bool
+	DownloadURL string
+	// ContentType is the type the server returned when a download was
+	// rejected for not being a zip file.
+	ContentType string
+	// DownloadStatusCode is the HTTP status an unreachable link returned, or
+	// 0 when it never answered, e.g. after too many redirects.
+	DownloadStatusCode int
+}
+
+const defaultLocale = "en"
+
+// defaultBodyTemplates is the built-in plain-text wording for each locale and
+// status.
+var defaultBodyTemplates = map[string]map[MailStatus]string{
+	"en": {
+		StatusSuccess:        "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has been successfully uploaded and no further action is needed.\n\nThe uploaded path is: {{.BucketPath}}  \n\n{{if .Attached}}A copy of your submission is attached to this email.\n\n{{end}}{{if .DownloadURL}}You can download it here: {{.DownloadURL}}\n\n{{end}}Thank you!",
+		StatusDownloadFailed: "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has NOT been uploaded because it could not be downloaded from the submission link. Please check the submission link or contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+		StatusUnreachable:    "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has NOT been uploaded because the submission link could not be reached. {{if .DownloadStatusCode}}The link returned HTTP status {{.DownloadStatusCode}}. {{end}}Please make sure the link is correct and publicly accessible, or contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+		StatusNotZip:         "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has NOT been uploaded because the submission link does not point to a zip file. {{if .ContentType}}The link returned content of type {{.ContentType}}. {{end}}Please link directly to your zip file or contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+		StatusFileTooSmall:   "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has NOT been uploaded because the file is empty or too small to be a complete submission. Please check that the zip file contains your work, update the submission link or contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+		StatusFileTooLarge:   "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has NOT been uploaded because the file is too large. Please reduce the size of your submission or contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+		StatusCorruptZip:     "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has NOT been uploaded because the zip file is corrupt or could not be opened. Please re-create the zip file, update the submission link or contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+		StatusAlreadyExists:  "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has NOT been uploaded because a submission with the same id already exists and resubmissions are not accepted. Please contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+		StatusUploadFailed:   "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has failed to upload to {{.Storage}} bucket. Please contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+		StatusUnknown:        "Hello,\n\nThis message is to inform you that your assignment with id {{.AssignmentId}} has NOT been uploaded. Please contact your TA for assistance to attempt and rectify the issue.\n\nThank you!",
+	},
+	"es": {
+		StatusSuccess:        "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} se ha subido correctamente y no se necesita ninguna otra acción.\n\nLa ruta de subida es: {{.BucketPath}}  \n\n{{if .Attached}}Se adjunta una copia de su entrega a este correo.\n\n{{end}}{{if .DownloadURL}}Puede descargarla aquí: {{.DownloadURL}}\n\n{{end}}¡Gracias!",
+		StatusDownloadFailed: "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} NO se ha subido porque no se pudo descargar desde el enlace de la entrega. Revise el enlace de la entrega o contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+		StatusUnreachable:    "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} NO se ha subido porque no se pudo acceder al enlace de la entrega. {{if .DownloadStatusCode}}El enlace devolvió el estado HTTP {{.DownloadStatusCode}}. {{end}}Asegúrese de que el enlace sea correcto y público, o contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+		StatusNotZip:         "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} NO se ha subido porque el enlace de la entrega no apunta a un archivo zip. {{if .ContentType}}El enlace devolvió contenido de tipo {{.ContentType}}. {{end}}Enlace directamente a su archivo zip o contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+		StatusFileTooSmall:   "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} NO se ha subido porque el archivo está vacío o es demasiado pequeño para ser una entrega completa. Compruebe que el archivo zip contiene su trabajo, actualice el enlace de la entrega o contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+		StatusFileTooLarge:   "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} NO se ha subido porque el archivo es demasiado grande. Reduzca el tamaño de su entrega o contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+		StatusCorruptZip:     "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} NO se ha subido porque el archivo zip está dañado o no se pudo abrir. Vuelva a crear el archivo zip, actualice el enlace de la entrega o contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+		StatusAlreadyExists:  "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} NO se ha subido porque ya existe una entrega con el mismo id y no se aceptan reenvíos. Contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+		StatusUploadFailed:   "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} no se pudo subir al bucket de {{.Storage}}. Contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+		StatusUnknown:        "Hola,\n\nEste mensaje es para informarle que su tarea con id {{.AssignmentId}} NO se ha subido. Contacte a su TA para intentar resolver el problema.\n\n¡Gracias!",
+	},
+}
+
+var builtinBodyTemplates = mustParseBodyTemplates(defaultBodyTemplates)
+
+// bodyTemplates holds the parsed plain-text templates by locale. It starts out
+// with the defaults and is replaced by LoadBodyTemplates at startup.
+var bodyTemplates = builtinBodyTemplates
+
+func mustParseBodyTemplates(src map[string]map[MailStatus]string) map[string]map[MailStatus]*texttemplate.Template {
+	tmpls, err := parseBodyTemplates(src)
+	if err != nil {
+		panic(err)
+	}
+	return tmpls
+}
+
+func parseBodyTemplates(src map[string]map[MailStatus]string) (map[string]map[MailStatus]*texttemplate.Template, error) {
+	tmpls := make(map[string]map[MailStatus]*texttemplate.Template, len(src))
+	for locale, texts := range src {
+		tmpls[locale] = make(map[MailStatus]*texttemplate.Template, len(texts))
+		for status, text := range texts {
+			tmpl, err := texttemplate.New(locale + "/" + string(status)).Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("template %s/%s: %w", locale, status, err)
+			}
+			tmpls[locale][status] = tmpl
+		}
+	}
+	return tmpls, nil
+}
+
+// LoadBodyTemplates replaces the built-in plain-text templates with any
+// overrides found in the environment. For each status the English template is
+// taken from MAIL_TEMPLATE_<STATUS> if set, otherwise from <STATUS>.txt under
+// MAIL_TEMPLATE_SOURCE, which is either a local directory or an
+// s3://bucket/prefix location. Other locales use MAIL_TEMPLATE_<STATUS>_<LOCALE>
+// and <STATUS>.<locale>.txt, and locales beyond the built-in ones can be added
+// with MAIL_LOCALES. Anything not overridden keeps the built-in wording for the
+// locale, or the English wording if there is none.
+func LoadBodyTemplates(ctx context.Context) error {
+	locales := make(map[string]bool)
+	for locale := range defaultBodyTemplates {
+		locales[locale] = true
+	}
+	for _, locale := range splitList(os.Getenv("MAIL_LOCALES")) {
+		locales[normalizeLocale(locale)] = true
+	}
+
+	source := os.Getenv("MAIL_TEMPLATE_SOURCE")
+	src := make(map[string]map[MailStatus]string, len(locales))
+	for locale := range locales {
+		envSuffix, fileSuffix := "", ".txt"
+		if locale != defaultLocale {
+			envSuffix = "_" + strings.ToUpper(strings.ReplaceAll(locale, "-", "_"))
+			fileSuffix = "." + locale + ".txt"
+		}
+
+		src[locale] = make(map[MailStatus]string, len(defaultBodyTemplates[defaultLocale]))
+		for status, def := range defaultBodyTemplates[defaultLocale] {
+			if text, ok := defaultBodyTemplates[locale][status]; ok {
+				def = text
+			}
+			src[locale][status] = def
+
+			if v := os.Getenv("MAIL_TEMPLATE_" + string(status) + envSuffix); v != "" {
+				src[locale][status] = v
+				continue
+			}
+			if source == "" {
+				continue
+			}
+
+			text, found, err := readTemplateSource(ctx, source, string(status)+fileSuffix)
+			if err != nil {
+				return fmt.Errorf("loading template %s/%s: %w", locale, status, err)
+			}
+			if found {
+				src[locale][status] = text
+			}
+		}
+	}
+
+	tmpls, err := parseBodyTemplates(src)
+	if err != nil {
+		return err
+	}
+	bodyTemplates = tmpls
+
+	return nil
+}
+
+// readTemplateSource reads name from a local directory or an s3:// prefix.
+// A missing file is reported as not found rather than an error.
+func readTemplateSource(ctx context.Context, source, name string) (string, bool, error) {
+	if rest, ok := strings.CutPrefix(source, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		key := strings.TrimSuffix(prefix, "/") + "/" + name
+		key = strings.TrimPrefix(key, "/")
+
+		out, err := s3.New(getAWSSession()).GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		defer out.Body.Close()
+
+		data, err := io.ReadAll(out.Body)
+		if err != nil {
+			return "", false, err
+		}
+		return string(data), true, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(source, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(locale)), "_", "-")
+}
+
+// resolveLocale picks the loaded locale that best matches locale, trying the
+// full tag and then its language ("es-MX" -> "es"), and defaulting to English.
+func resolveLocale(locale string) string {
+	locale = normalizeLocale(locale)
+	if _, ok := bodyTemplates[locale]; ok {
+		return locale
+	}
+	if lang, _, found := strings.Cut(locale, "-"); found {
+		if _, ok := bodyTemplates[lang]; ok {
+			return lang
+		}
+	}
+	return defaultLocale
+}
+
+// GenerateBody renders the plain-text email body for status in the message's
+// locale. If a loaded template fails to render, the built-in wording is used
+// instead.
+func GenerateBody(status MailStatus, message Structmsg, bucketPath string, opts BodyOptions) string {
+	locale := resolveLocale(message.Locale)
+	tmpl, ok := bodyTemplates[locale][status]
+	if !ok {
+		status = StatusUnknown
+		tmpl = bodyTemplates[locale][status]
+	}
+
+	data := bodyData{Structmsg: message, Storage: storageName(), BodyOptions: opts}
+	if status == StatusSuccess {
+		data.BucketPath = displayPath(message.Bucket(), bucketPath, opts.DownloadURL)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		logger.Warn("Error rendering mail template, using default", "status", status, "locale", locale, "error", err)
+		builtin, ok := builtinBodyTemplates[locale][status]
+		if !ok {
+			builtin = builtinBodyTemplates[defaultLocale][status]
+		}
+		buf.Reset()
+		builtin.Execute(&buf, data)
+	}
+
+	return ellipsize(buf.String(), mailBodyMaxChars())
+}
+
+// mailBodyMaxChars is MAIL_BODY_MAX_CHARS, the longest body a mail gets; 0
+// removes the limit. The templates themselves are far shorter, so only an
+// outsized path or error string brings a body near it.
+func mailBodyMaxChars() int {
+	return getEnvInt("MAIL_BODY_MAX_CHARS", 20000)
+}
+
+// ellipsize cuts s to at most maxLen characters, ending it with "…" when it
+// was cut. A maxLen of 0 or less leaves s whole.
+func ellipsize(s string, maxLen int) string {
+	if maxLen <= 0 || utf8.RuneCountInString(s) <= maxLen {
+		return s
+	}
+	i := 0
+	for n := 0; n < maxLen-1; n++ {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return s[:i] + "…"
+}
+
+type bodyData struct {
+	Structmsg
+	BucketPath string
+	// Storage names the storage provider, e.g. "GCP" or "S3".
+	Storage string
+	BodyOptions
+}
+
+var htmlTemplates = map[MailStatus]*template.Template{
+	StatusSuccess:        template.Must(template.New("success").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has been successfully uploaded and no further action is needed.</p><p>The uploaded path is: <code>{{.BucketPath}}</code></p>{{if .Attached}}<p>A copy of your submission is attached to this email.</p>{{end}}{{if .DownloadURL}}<p>You can download it <a href="{{.DownloadURL}}">here</a>.</p>{{end}}<p>Thank you!</p>`)),
+	StatusDownloadFailed: template.Must(template.New("downloadFailed").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has <b>NOT</b> been uploaded because it could not be downloaded from the submission link. Please check the submission link or contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+	StatusUnreachable:    template.Must(template.New("unreachable").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has <b>NOT</b> been uploaded because the submission link could not be reached. {{if .DownloadStatusCode}}The link returned HTTP status <b>{{.DownloadStatusCode}}</b>. {{end}}Please make sure the link is correct and publicly accessible, or contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+	StatusNotZip:         template.Must(template.New("notZip").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has <b>NOT</b> been uploaded because the submission link does not point to a zip file. {{if .ContentType}}The link returned content of type <b>{{.ContentType}}</b>. {{end}}Please link directly to your zip file or contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+	StatusFileTooSmall:   template.Must(template.New("fileTooSmall").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has <b>NOT</b> been uploaded because the file is empty or too small to be a complete submission. Please check that the zip file contains your work, update the submission link or contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+	StatusFileTooLarge:   template.Must(template.New("fileTooLarge").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has <b>NOT</b> been uploaded because the file is too large. Please reduce the size of your submission or contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+	StatusCorruptZip:     template.Must(template.New("corruptZip").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has <b>NOT</b> been uploaded because the zip file is corrupt or could not be opened. Please re-create the zip file, update the submission link or contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+	StatusAlreadyExists:  template.Must(template.New("alreadyExists").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has <b>NOT</b> been uploaded because a submission with the same id already exists and resubmissions are not accepted. Please contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+	StatusUploadFailed:   template.Must(template.New("uploadFailed").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has failed to upload to {{.Storage}} bucket. Please contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+	StatusUnknown:        template.Must(template.New("unknown").Parse(`<p>Hello,</p><p>This message is to inform you that your assignment with id <b>{{.AssignmentId}}</b> has <b>NOT</b> been uploaded. Please contact your TA for assistance to attempt and rectify the issue.</p><p>Thank you!</p>`)),
+}
+
+// GenerateHTMLBody renders the HTML counterpart of GenerateBody. The HTML
+// templates are English only, so other locales get an empty HTML body and the
+// mail goes out as plain text.
+func GenerateHTMLBody(status MailStatus, message Structmsg, bucketPath string, opts BodyOptions) (string, error) {
+	if resolveLocale(message.Locale) != defaultLocale {
+		return "", nil
+	}
+
+	tmpl, ok := htmlTemplates[status]
+	if !ok {
+		tmpl = htmlTemplates[StatusUnknown]
+	}
+
+	data := bodyData{Structmsg: message, Storage: storageName(), BodyOptions: opts}
+	if status == StatusSuccess {
+		data.BucketPath = displayPath(message.Bucket(), bucketPath, opts.DownloadURL)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	// Cutting markup could leave it broken, so an HTML body over the limit
+	// is dropped and the mail goes out with the plain text only.
+	if limit := mailBodyMaxChars(); limit > 0 && utf8.RuneCount(buf.Bytes()) > limit {
+		return "", fmt.Errorf("HTML body is over MAIL_BODY_MAX_CHARS (%d)", limit)
+	}
+
+	return buf.String(), nil
+}
+
+var (
+	mailgunOnce   sync.Once
+	mailgunClient mailgun.Mailgun
+)
+
+// getMailgun returns the Mailgun client shared across invocations. Like the
+// AWS clients it is safe for concurrent use.
+func getMailgun() mailgun.Mailgun {
+	mailgunOnce.Do(func() {
+		mailgunClient = mailgun.NewMailgun(os.Getenv("MAILGUN_DOMAIN"), os.Getenv("MAILGUN_PVT_API_KEY"))
+		base, err := mailgunAPIBase()
+		if err != nil {
+			logger.Warn("Invalid Mailgun region, using US endpoint", "error", err)
+			base = mailgun.APIBaseUS
+		}
+		mailgunClient.SetAPIBase(base)
+	})
+	return mailgunClient
+}
+
+var ErrMailRateLimited = errors.New("Mail rate limit would exceed the deadline")
+
+var ErrMailNotAccepted = errors.New("Mail not accepted by Mailgun")
+
+// Mailgun delivery statuses stored on MailReceipt and as MailgunStatus.
+const (
+	MailgunQueued   = "queued"
+	MailgunAccepted = "accepted"
+	MailgunRejected = "rejected"
+)
+
+// mailgunStatus reads the status from the message Mailgun returns with a
+// send, normally "Queued. Thank you.". Anything other than queued or
+// accepted is rejected.
+func mailgunStatus(response string) string {
+	response = strings.ToLower(strings.TrimSpace(response))
+	for _, status := range []string{MailgunQueued, MailgunAccepted} {
+		if strings.HasPrefix(response, status) {
+			return status
+		}
+	}
+	return MailgunRejected
+}
+
+var (
+	mailLimiterOnce sync.Once
+	mailLimiter     *rate.Limiter
+)
+
+// getMailLimiter returns the token bucket shared by every SendMail in the
+// process, allowing MAILGUN_RATE_PER_SEC sends a second with bursts of
+// MAILGUN_RATE_BURST. It is nil, meaning unlimited, when no rate is set.
+func getMailLimiter() *rate.Limiter {
+	mailLimiterOnce.Do(func() {
+		perSec, err := mailRatePerSec()
+		if err != nil {
+			logger.Warn("Invalid MAILGUN_RATE_PER_SEC, not rate limiting mail", "error", err)
+			return
+		}
+		if perSec > 0 {
+			mailLimiter = rate.NewLimiter(rate.Limit(perSec), max(getEnvInt("MAILGUN_RATE_BURST", 1), 1))
+		}
+	})
+	return mailLimiter
+}
+
+func mailRatePerSec() (float64, error) {
+	v := os.Getenv("MAILGUN_RATE_PER_SEC")
+	if v == "" {
+		return 0, nil
+	}
+	perSec, err := strconv.ParseFloat(v, 64)
+	if err == nil && perSec < 0 {
+		err = fmt.Errorf("rate %v is negative", perSec)
+	}
+	return perSec, err
+}
+
+// waitMailLimiter blocks until the limiter allows a send. It fails at once
+// with ErrMailRateLimited if the wait would outlast ctx's deadline.
+func waitMailLimiter(ctx context.Context) error {
+	limiter := getMailLimiter()
+	if limiter == nil {
+		return nil
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrMailRateLimited, err)
+	}
+	return nil
+}
+
+// mailgunAPIBase picks the API endpoint from MAILGUN_API_BASE, or failing
+// that MAILGUN_REGION ("us" or "eu"). It defaults to the US endpoint.
+func mailgunAPIBase() (string, error) {
+	if base := os.Getenv("MAILGUN_API_BASE"); base != "" {
+		return base, nil
+	}
+
+	switch strings.ToLower(os.Getenv("MAILGUN_REGION")) {
+	case "", "us":
+		return mailgun.APIBaseUS, nil
+	case "eu":
+		return mailgun.APIBaseEU, nil
+	}
+
+	return "", fmt.Errorf("unknown MAILGUN_REGION %q, expected us or eu", os.Getenv("MAILGUN_REGION"))
+}
+
+// Email is a single notification to send.
+type Email struct {
+	To  []string
+	Cc  []string
+	Bcc []string
+	// Subject defaults to SUBJECT when empty.
+	Subject    string
+	Body       string
+	HTMLBody   string
+	Attachment *Attachment
+	// Tags and Headers are passed to Mailgun as o:tag and h: fields.
+	Tags    []string
+	Headers map[string]string
+}
+
+// MailTags returns the Mailgun tags for a message: MAIL_TAGS followed by the
+// message's AssignmentId, so the dashboard can split delivery stats per
+// assignment. Mailgun takes at most mailgun.MaxNumberOfTags tags of 128 ASCII
+// characters; past that the extra tags are dropped and an error returned.
+func MailTags(msg Structmsg) ([]string, error) {
+	tags := splitList(os.Getenv("MAIL_TAGS"))
+	if msg.AssignmentId != "" {
+		tags = append(tags, msg.AssignmentId)
+	}
+	for i, tag := range tags {
+		tags[i] = sanitizeMailTag(tag)
+	}
+
+	if len(tags) > mailgun.MaxNumberOfTags {
+		return tags[:mailgun.MaxNumberOfTags], fmt.Errorf("%d mail tags (MAIL_TAGS plus the assignment), Mailgun allows %d", len(tags), mailgun.MaxNumberOfTags)
+	}
+	return tags, nil
+}
+
+func sanitizeMailTag(tag string) string {
+	tag = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, tag)
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+// MailHeaders returns the custom headers for a message: MAIL_HEADERS, a
+// comma-separated list of Name=value pairs such as X-Course-Id=CS101, plus
+// X-Assignment-Id with the message's assignment.
+func MailHeaders(msg Structmsg) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range splitList(os.Getenv("MAIL_HEADERS")) {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t:") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid MAIL_HEADERS entry %q, expected Name=value", pair)
+		}
+		headers[textproto.CanonicalMIMEHeaderKey(name)] = strings.TrimSpace(value)
+	}
+
+	if msg.AssignmentId != "" {
+		headers["X-Assignment-Id"] = strings.NewReplacer("\r", "", "\n", "").Replace(msg.AssignmentId)
+	}
+	return headers, nil
+}
+
+// MailSubject picks the subject for a mail with the given status:
+// MAIL_SUBJECT_<STATUS> (e.g. MAIL_SUBJECT_SUCCESS, MAIL_SUBJECT_FILE_TOO_LARGE),
+// then MAIL_SUBJECT_FAILURE for any status other than success, then SUBJECT.
+// An {AssignmentId} placeholder is replaced with the message's assignment.
+func MailSubject(status MailStatus, msg Structmsg) string {
+	subject := os.Getenv("MAIL_SUBJECT_" + string(status))
+	if subject == "" && status != StatusSuccess {
+		subject = os.Getenv("MAIL_SUBJECT_FAILURE")
+	}
+	if subject == "" {
+		subject = os.Getenv("SUBJECT")
+	}
+	return strings.ReplaceAll(subject, "{AssignmentId}", msg.AssignmentId)
+}
+
+// MailSender returns the From header. SENDER may be a bare address or a
+// "Course Staff <noreply@course.edu>" form; a bare address takes its display
+// name from SENDER_NAME. If the composed header does not parse, the bare
+// address is used on its own.
+func MailSender() string {
+	sender := strings.TrimSpace(os.Getenv("SENDER"))
+	addr, err := mail.ParseAddress(sender)
+	if err != nil {
+		logger.Warn("SENDER is not a valid address, using it as is", "stage", "mail", "error", err)
+		return sender
+	}
+	if addr.Name == "" {
+		addr.Name = strings.TrimSpace(os.Getenv("SENDER_NAME"))
+	}
+	if addr.Name == "" {
+		return addr.Address
+	}
+
+	from := addr.String()
+	if _, err := mail.ParseAddress(from); err != nil {
+		logger.Warn("Invalid sender name, using the bare address", "stage", "mail", "error", err)
+		return addr.Address
+	}
+	return from
+}
+
+type Attachment struct {
+	Filename string
+	Data     []byte
+}
+
+// SendMail sends the notification, retrying up to MAIL_MAX_RETRIES times on
+// network errors and 429/5xx responses. It also returns how many attempts were
+// made. A 2xx response only counts as sent if Mailgun says the mail was
+// queued or accepted; otherwise it fails with ErrMailNotAccepted.
+func SendMail(ctx context.Context, email Email) (MailReceipt, error) {
+	//return "sample", "sample2", nil
+	for _, to := range email.To {
+		if err := ValidateRecipient(ctx, to); err != nil {
+			loggerFrom(ctx).Warn("Not sending to invalid recipient", "stage", "mail", "error", err)
+			return MailReceipt{}, err
+		}
+	}
+
+	mg := getMailgun()
+	subject := email.Subject
+	if subject == "" {
+		subject = os.Getenv("SUBJECT")
+	}
+	message := mg.NewMessage(MailSender(), subject, email.Body, email.To...)
+	for _, cc := range email.Cc {
+		message.AddCC(cc)
+	}
+	for _, bcc := range email.Bcc {
+		message.AddBCC(bcc)
+	}
+	if email.HTMLBody != "" {
+		message.SetHtml(email.HTMLBody)
+	}
+	if email.Attachment != nil {
+		message.AddBufferAttachment(email.Attachment.Filename, email.Attachment.Data)
+	}
+	if len(email.Tags) > 0 {
+		if err := message.AddTag(email.Tags...); err != nil {
+			loggerFrom(ctx).Warn("Error tagging mail, sending untagged", "stage", "mail", "error", err)
+		}
+	}
+	for name, value := range email.Headers {
+		message.AddHeader(name, value)
+	}
+
+	maxRetries := retryBudget(ctx, getEnvInt("MAIL_MAX_RETRIES", 2))
+	backoff := time.Duration(getEnvInt("MAIL_BACKOFF_MS", 1000)) * time.Millisecond
+
+	var receipt MailReceipt
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := backoffDelay(backoff, attempt)
+			loggerFrom(ctx).Info("Retrying mail", "stage", "mail", "delay", delay.String(), "attempt", attempt, "max_retries", maxRetries)
+			if serr := sleepContext(ctx, delay); serr != nil {
+				break
+			}
+		}
+
+		if err = waitMailLimiter(ctx); err != nil {
+			loggerFrom(ctx).Error("Error waiting for mail rate limit", "stage", "mail", "attempt", attempt+1, "error", err)
+			return receipt, err
+		}
+
+		receipt.Attempts = attempt + 1
+		err = traceCapture(ctx, "mailgun.send", func(ctx context.Context) error {
+			var serr error
+			receipt.Response, receipt.Id, serr = mg.Send(ctx, message)
+			return serr
+		})
+		if err == nil {
+			receipt.StatusCode = http.StatusOK
+			if receipt.Status = mailgunStatus(receipt.Response); receipt.Status != MailgunRejected {
+				return receipt, nil
+			}
+			err = fmt.Errorf("%w: %q", ErrMailNotAccepted, receipt.Response)
+			loggerFrom(ctx).Error("Mailgun did not accept the mail", "stage", "mail", "response", receipt.Response, "mailgun_id", receipt.Id, "attempt", attempt+1, "error", err)
+			return receipt, err
+		}
+
+		fillReceiptFromError(&receipt, err)
+		loggerFrom(ctx).Error("Error sending mail", "stage", "mail", "response", receipt.Response, "mailgun_id", receipt.Id, "status", receipt.StatusCode, "attempt", attempt+1, "error", err)
+		if !isRetryableMailError(err) {
+			return receipt, err
+		}
+	}
+
+	return receipt, err
+}
+
+var notifyClient = &http.Client{
+	Transport: tracingTransport{base: http.DefaultTransport},
+	Timeout:   time.Duration(getEnvInt("NOTIFY_TIMEOUT_SECONDS", 10)) * time.Second,
+}
+
+// NotificationEvent is the JSON body the webhook notifier POSTs.
+type NotificationEvent struct {
+	Status        MailStatus `json:"Status"`
+	SubmissionId  string     `json:"SubmissionId"`
+	AssignmentId  string     `json:"AssignmentId"`
+	UserId        string     `json:"UserId"`
+	Path          string     `json:"Path,omitempty"`
+	CorrelationId string     `json:"CorrelationId"`
+}
+
+type webhookNotifier struct {
+	url string
+}
+
+func (webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, status MailStatus, msg Structmsg, path string) error {
+	return postJSON(ctx, n.url, NotificationEvent{
+		Status:        status,
+		SubmissionId:  msg.SubmissionId,
+		AssignmentId:  msg.AssignmentId,
+		UserId:        msg.UserId,
+		Path:          path,
+		CorrelationId: CorrelationId(ctx),
+	})
+}
+
+// sesMailer sends the email through Amazon SES. Tags and headers are
+// Mailgun's and are left out, and so is any attachment, as SendEmail cannot
+// carry one.
+type sesMailer struct{}
+
+func (sesMailer) Name() string {
+	return "ses"
+}
+
+func (sesMailer) Send(ctx context.Context, email Email) (MailReceipt, error) {
+	subject := email.Subject
+	if subject == "" {
+		subject = os.Getenv("SUBJECT")
+	}
+	body := &ses.Body{Text: &ses.Content{Charset: aws.String("UTF-8"), Data: aws.String(email.Body)}}
+	if email.HTMLBody != "" {
+		body.Html = &ses.Content{Charset: aws.String("UTF-8"), Data: aws.String(email.HTMLBody)}
+	}
+
+	out, err := getSESClient().SendEmailWithContext(ctx, &ses.SendEmailInput{
+		Source: aws.String(MailSender()),
+		Destination: &ses.Destination{
+			ToAddresses:  aws.StringSlice(email.To),
+			CcAddresses:  aws.StringSlice(email.Cc),
+			BccAddresses: aws.StringSlice(email.Bcc),
+		},
+		Message: &ses.Message{
+			Subject: &ses.Content{Charset: aws.String("UTF-8"), Data: aws.String(subject)},
+			Body:    body,
+		},
+	})
+	if err != nil {
+		return MailReceipt{Attempts: 1}, err
+	}
+	return MailReceipt{Id: aws.StringValue(out.MessageId), Response: "sent via SES", Attempts: 1}, nil
+}
+
+// FallbackEmail is the JSON body webhookMailer posts, for a service of the
+// deployment's own to deliver.
+type FallbackEmail struct {
+	To            []string          `json:"to"`
+	Cc            []string          `json:"cc,omitempty"`
+	Bcc           []string          `json:"bcc,omitempty"`
+	Subject       string            `json:"subject"`
+	Body          string            `json:"body"`
+	HTMLBody      string            `json:"htmlBody,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	CorrelationId string            `json:"correlationId"`
+}
+
+type webhookMailer struct {
+	url string
+}
+
+func (webhookMailer) Name() string {
+	return "webhook"
+}
+
+func (m webhookMailer) Send(ctx context.Context, email Email) (MailReceipt, error) {
+	subject := email.Subject
+	if subject == "" {
+		subject = os.Getenv("SUBJECT")
+	}
+	err := postJSON(ctx, m.url, FallbackEmail{
+		To:            email.To,
+		Cc:            email.Cc,
+		Bcc:           email.Bcc,
+		Subject:       subject,
+		Body:          email.Body,
+		HTMLBody:      email.HTMLBody,
+		Headers:       email.Headers,
+		CorrelationId: CorrelationId(ctx),
+	})
+	if err != nil {
+		return MailReceipt{Attempts: 1}, err
+	}
+	return MailReceipt{Response: "posted to webhook", Attempts: 1}, nil
+}
+
+type slackNotifier struct {
+	url string
+}
+
+func (slackNotifier) Name() string {
+	return "slack"
+}
+
+func (n slackNotifier) Notify(ctx context.Context, status MailStatus, msg Structmsg, path string) error {
+	text := fmt.Sprintf("Submission %s for assignment %s by %s: %s", msg.SubmissionId, msg.AssignmentId, msg.UserId, status)
+	if path != "" {
+		text += "\n" + path
+	}
+	return postJSON(ctx, n.url, map[string]string{"text": text})
+}
+
+// postJSON POSTs v as JSON to url and treats any non-2xx answer as an error.
+func postJSON(ctx context.Context, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// fillReceiptFromError records the HTTP status of a failed send and, when
+// Mailgun still returned a JSON body, its message and id.
+func fillReceiptFromError(receipt *MailReceipt, err error) {
+	receipt.StatusCode, receipt.Status = 0, ""
+	if status := mailgun.GetStatusFromErr(err); status > 0 {
+		receipt.StatusCode, receipt.Status = status, MailgunRejected
+	}
+
+	var uerr *mailgun.UnexpectedResponseError
+	if !errors.As(err, &uerr) {
+		return
+	}
+	var body struct {
+		Id      string `json:"id"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(uerr.Data, &body) != nil {
+		return
+	}
+	if body.Id != "" {
+		receipt.Id = body.Id
+	}
+	if body.Message != "" {
+		receipt.Response = body.Message
+	}
+}
+
+// isRetryableMailError reports whether a Mailgun failure is transient. Errors
+// without an HTTP status are network failures; 429 and 5xx are throttling or
+// outages. Any other status (bad recipient, auth) will not improve on retry.
+func isRetryableMailError(err error) bool {
+	status := mailgun.GetStatusFromErr(err)
+	return status == -1 || status == http.StatusTooManyRequests || status >= 500
+}
+
+var requiredEnv = []string{"BUCKET", "MAIL_TABLE", "MAILGUN_DOMAIN", "MAILGUN_PVT_API_KEY", "SENDER", "SUBJECT"}
+
+// CheckConfig reports the first missing or invalid setting, so a
+// misconfigured function fails at start instead of on its first record.
+func CheckConfig() error {
+	backend := storageBackend()
+	if backend != BackendGCS && backend != BackendS3 {
+		return fmt.Errorf("unknown STORAGE_BACKEND %q, expected gcs or s3", backend)
+	}
+
+	if trigger := Trigger(); trigger != TriggerSNS && trigger != TriggerSQS {
+		return fmt.Errorf("unknown TRIGGER %q, expected sns or sqs", trigger)
+	}
+
+	required := slices.Clone(requiredEnv)
+	if backend == BackendGCS {
+		required = append(required, "GCP_CREDS_JSON")
+	}
+
+	missing := []string{}
+	for _, key := range required {
+		if os.Getenv(key) == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
+	}
+
+	if _, err := BuildObjectKey(os.Getenv("OBJECT_KEY_TEMPLATE"), Structmsg{AssignmentId: "a", UserId: "u", SubmissionId: "s"}); err != nil {
+		return err
+	}
+
+	switch p := os.Getenv("OVERWRITE_POLICY"); p {
+	case "", OverwriteAllow, OverwriteReject, OverwriteVersion:
+	default:
+		return fmt.Errorf("unknown OVERWRITE_POLICY %q, expected overwrite, reject or version", p)
+	}
+
+	if m := writeMode(); m != WriteModeAppend && m != WriteModeVersioned {
+		return fmt.Errorf("unknown MAIL_TABLE_WRITE_MODE %q, expected append or versioned", m)
+	}
+
+	if acl := os.Getenv("OBJECT_ACL"); acl != "" && !validObjectACL(acl) {
+		return fmt.Errorf("unknown OBJECT_ACL %q, expected %s or %s", acl, strings.Join(gcsPredefinedACLs, ", "), ObjectACLNone)
+	}
+
+	if _, err := ObjectLabels(os.Getenv("OBJECT_LABELS"), Structmsg{}, clock.Now()); err != nil {
+		return err
+	}
+
+	if _, err := DisplayPath(os.Getenv("PATH_DISPLAY_TEMPLATE"), "b", "k", "u"); err != nil {
+		return err
+	}
+
+	if _, err := mailgunAPIBase(); err != nil {
+		return err
+	}
+
+	if _, err := mailRatePerSec(); err != nil {
+		return fmt.Errorf("invalid MAILGUN_RATE_PER_SEC: %w", err)
+	}
+
+	if _, err := blockedCIDRs(); err != nil {
+		return fmt.Errorf("invalid BLOCKED_CIDRS: %w", err)
+	}
+
+	if _, err := downloadTLSConfig(); err != nil {
+		return err
+	}
+
+	for _, override := range splitList(os.Getenv("RETRY_OVERRIDES")) {
+		name, value, ok := strings.Cut(override, "=")
+		if _, err := strconv.ParseBool(strings.TrimSpace(value)); !ok || name == "" || err != nil {
+			return fmt.Errorf("invalid RETRY_OVERRIDES entry %q, expected reason=true or reason=false", override)
+		}
+	}
+
+	if _, err := fallbackFromEnv(); err != nil {
+		return err
+	}
+
+	if _, _, err := notifiersFromEnv(); err != nil {
+		return err
+	}
+
+	if _, err := transformFor(os.Getenv("TRANSFORM")); err != nil {
+		return err
+	}
+
+	if _, err := MailTags(Structmsg{AssignmentId: "a"}); err != nil {
+		return fmt.Errorf("invalid MAIL_TAGS: %w", err)
+	}
+	if _, err := MailHeaders(Structmsg{}); err != nil {
+		return err
+	}
+
+	switch m := digestMode(); m {
+	case "", DigestBcc, DigestBatch:
+	default:
+		return fmt.Errorf("unknown DIGEST_MODE %q, expected bcc or batch", m)
+	}
+
+	if os.Getenv("ARCHIVE_EVENTS") == "true" && os.Getenv("ARCHIVE_BUCKET") == "" {
+		return errors.New("ARCHIVE_EVENTS is true but ARCHIVE_BUCKET is not set")
+	}
+
+	if os.Getenv("DOWNLOAD_AUTH_HEADER") != "" && os.Getenv("DOWNLOAD_AUTH_HOSTS") == "" {
+		return errors.New("DOWNLOAD_AUTH_HEADER is set but DOWNLOAD_AUTH_HOSTS is empty, so it would never be sent")
+	}
+
+	if backend == BackendGCS {
+		if _, err := gcpCredentials(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,3058 @@
+package pipeline
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/mailgun/mailgun-go/v4"
+	"google.golang.org/api/option"
+)
+
+type fakeDownloader struct {
+	body string
+	err  error
+}
+
+func (d *fakeDownloader) Download(ctx context.Context, url string) (io.ReadCloser, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return io.NopCloser(strings.NewReader(d.body)), nil
+}
+
+type fakeUploader struct {
+	mu       sync.Mutex
+	err      error
+	key      string
+	bucket   string
+	uploaded string
+}
+
+func (u *fakeUploader) Upload(ctx context.Context, key string, msg Structmsg, r io.Reader) error {
+	if u.err != nil {
+		return u.err
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.key, u.bucket, u.uploaded = key, bucketFrom(ctx), string(b)
+	return nil
+}
+
+func (u *fakeUploader) SignedURL(ctx context.Context, key string) (string, error) {
+	return "https://storage.example.com/" + key + "?signed", nil
+}
+
+type fakeMailer struct {
+	mu        sync.Mutex
+	err       error
+	email     Email
+	body      string
+	recipient string
+}
+
+func (m *fakeMailer) Send(ctx context.Context, email Email) (MailReceipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.email = email
+	m.body, m.recipient = email.Body, strings.Join(email.To, ",")
+	if m.err != nil {
+		return MailReceipt{StatusCode: http.StatusBadRequest, Attempts: 1}, m.err
+	}
+	return MailReceipt{Response: "Queued. Thank you.", Id: "<id@mailgun>", StatusCode: http.StatusOK, Status: MailgunQueued, Attempts: 1}, nil
+}
+
+type fakeArchiver struct {
+	mu   sync.Mutex
+	keys []string
+	data [][]byte
+}
+
+func (a *fakeArchiver) Archive(ctx context.Context, key string, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = append(a.keys, key)
+	a.data = append(a.data, data)
+	return nil
+}
+
+type fakeAlerter struct {
+	mu     sync.Mutex
+	err    error
+	events []FailureEvent
+}
+
+func (a *fakeAlerter) Alert(ctx context.Context, event FailureEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, event)
+	return a.err
+}
+
+type fakeRecorder struct {
+	mu          sync.Mutex
+	items       []Item
+	deadLetters []DeadLetter
+	claimed     map[string]bool
+	released    []string
+	batches     int
+}
+
+func (r *fakeRecorder) Record(ctx context.Context, item Item) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, item)
+}
+
+func (r *fakeRecorder) RecordBatch(ctx context.Context, items []Item) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, items...)
+	r.batches++
+}
+
+func (r *fakeRecorder) DeadLetter(ctx context.Context, entry DeadLetter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadLetters = append(r.deadLetters, entry)
+}
+
+func (r *fakeRecorder) Claim(ctx context.Context, submissionId, messageId string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.claimed == nil {
+		r.claimed = map[string]bool{}
+	}
+	if r.claimed[submissionId] {
+		return false, nil
+	}
+	r.claimed[submissionId] = true
+	return true, nil
+}
+
+func (r *fakeRecorder) LoadRecord(ctx context.Context, submissionId string) (events.SNSEventRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var record events.SNSEventRecord
+	for i := len(r.items) - 1; i >= 0; i-- {
+		if r.items[i].SubmissionId == submissionId {
+			err := json.Unmarshal([]byte(r.items[i].RequestMetadata), &record)
+			return record, err
+		}
+	}
+	return record, ErrRecordNotFound
+}
+
+func (r *fakeRecorder) Release(ctx context.Context, submissionId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.released = append(r.released, submissionId)
+	delete(r.claimed, submissionId)
+}
+
+func testRecord(t *testing.T, msg Structmsg) events.SNSEventRecord {
+	t.Helper()
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.SNSEventRecord{SNS: events.SNSEntity{MessageID: "sns-1", Message: string(b)}}
+}
+
+var testMsg = Structmsg{
+	SubmissionEmail: "student@example.com",
+	SubmissionUrl:   "https://example.com/submission.zip",
+	SubmissionId:    "sub-1",
+	AssignmentId:    "asg-1",
+	UserId:          "user-1",
+}
+
+func TestProcessRecord(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+
+	tests := []struct {
+		name          string
+		downloadErr   error
+		uploadErr     error
+		mailErr       error
+		wantStatus    MailStatus
+		wantMailSent  bool
+		wantRetryable bool
+		wantUploaded  bool
+		wantBody      string
+	}{
+		{
+			name:         "success",
+			wantStatus:   StatusSuccess,
+			wantMailSent: true,
+			wantUploaded: true,
+			wantBody:     "https://storage.example.com/asg-1/user-1/sub-1?signed",
+		},
+		{
+			name:          "download network failure",
+			downloadErr:   &retryableError{errors.New("connection reset")},
+			wantStatus:    StatusDownloadFailed,
+			wantMailSent:  true,
+			wantRetryable: true,
+			wantBody:      "could not be downloaded from the submission link",
+		},
+		{
+			name:         "download not a zip",
+			downloadErr:  fmt.Errorf("%w: got text/html", ErrNotZip),
+			wantStatus:   StatusNotZip,
+			wantMailSent: true,
+			wantBody:     "does not point to a zip file",
+		},
+		{
+			name:         "download unreachable",
+			downloadErr:  fmt.Errorf("%w: status 404 Not Found", ErrUnreachable),
+			wantStatus:   StatusUnreachable,
+			wantMailSent: true,
+			wantBody:     "could not be reached",
+		},
+		{
+			name:         "download too large",
+			downloadErr:  ErrFileTooLarge,
+			wantStatus:   StatusFileTooLarge,
+			wantMailSent: true,
+			wantBody:     "too large",
+		},
+		{
+			name:          "upload failure",
+			uploadErr:     errors.New("503 from GCS"),
+			wantStatus:    StatusUploadFailed,
+			wantMailSent:  true,
+			wantRetryable: true,
+			wantBody:      "failed to upload",
+		},
+		{
+			name:         "object exists",
+			uploadErr:    ErrObjectExists,
+			wantStatus:   StatusAlreadyExists,
+			wantMailSent: true,
+			wantBody:     "already exists",
+		},
+		{
+			name:         "mail failure",
+			mailErr:      errors.New("401 unauthorized"),
+			wantStatus:   StatusSuccess,
+			wantUploaded: true,
+			wantBody:     "successfully uploaded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploader := &fakeUploader{err: tt.uploadErr}
+			mailer := &fakeMailer{err: tt.mailErr}
+			recorder := &fakeRecorder{}
+			p := &Processor{
+				Downloader: &fakeDownloader{body: "PK\x03\x04data", err: tt.downloadErr},
+				Uploader:   uploader,
+				Mailer:     mailer,
+				Recorder:   recorder,
+			}
+
+			result := p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+			if result.MailStatus != tt.wantStatus {
+				t.Errorf("MailStatus = %s, want %s", result.MailStatus, tt.wantStatus)
+			}
+			if result.MailSent != tt.wantMailSent {
+				t.Errorf("MailSent = %v, want %v", result.MailSent, tt.wantMailSent)
+			}
+			if result.retryable != tt.wantRetryable {
+				t.Errorf("retryable = %v, want %v", result.retryable, tt.wantRetryable)
+			}
+			if got := uploader.uploaded != ""; got != tt.wantUploaded {
+				t.Errorf("uploaded = %v, want %v", got, tt.wantUploaded)
+			}
+			if !strings.Contains(mailer.body, tt.wantBody) {
+				t.Errorf("mail body %q does not contain %q", mailer.body, tt.wantBody)
+			}
+			if mailer.recipient != testMsg.SubmissionEmail {
+				t.Errorf("recipient = %q, want %q", mailer.recipient, testMsg.SubmissionEmail)
+			}
+			if len(recorder.items) != 1 {
+				t.Fatalf("recorded %d items, want 1", len(recorder.items))
+			}
+			item := recorder.items[0]
+			if item.MailStatus != tt.wantStatus || item.IsMailSent != tt.wantMailSent {
+				t.Errorf("recorded item = %+v", item)
+			}
+			if item.Retryable != tt.wantRetryable {
+				t.Errorf("item Retryable = %v, want %v", item.Retryable, tt.wantRetryable)
+			}
+			if item.IsUploaded != tt.wantUploaded || result.Uploaded != tt.wantUploaded {
+				t.Errorf("IsUploaded = %v, Uploaded = %v, want %v", item.IsUploaded, result.Uploaded, tt.wantUploaded)
+			}
+			if want := tt.wantUploaded && !tt.wantMailSent; item.UnnotifiedUpload != want || result.UnnotifiedUpload != want {
+				t.Errorf("UnnotifiedUpload = %v, want %v", item.UnnotifiedUpload, want)
+			}
+			if (item.MailError != "") != (tt.mailErr != nil) {
+				t.Errorf("MailError = %q, want the error of %v", item.MailError, tt.mailErr)
+			}
+			if tt.wantUploaded && item.FileSizeBytes != int64(len(uploader.uploaded)) {
+				t.Errorf("FileSizeBytes = %d, want %d", item.FileSizeBytes, len(uploader.uploaded))
+			}
+			if sum := sha256.Sum256([]byte(uploader.uploaded)); tt.wantUploaded && item.FileSHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("FileSHA256 = %q, want digest of uploaded bytes", item.FileSHA256)
+			}
+			if (result.Failure != nil) != (tt.wantStatus != StatusSuccess || !tt.wantMailSent) {
+				t.Errorf("Failure = %+v for status %s", result.Failure, tt.wantStatus)
+			}
+			if item.Failure != result.Failure || item.Error != result.Error {
+				t.Errorf("recorded failure %+v / %q, want %+v / %q", item.Failure, item.Error, result.Failure, result.Error)
+			}
+			if (len(recorder.released) == 1) != tt.wantRetryable {
+				t.Errorf("released = %v, want release only when retryable", recorder.released)
+			}
+		})
+	}
+}
+
+func TestProcessRecordInvalidMessage(t *testing.T) {
+	mailer := &fakeMailer{}
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{},
+		Uploader:   &fakeUploader{},
+		Mailer:     mailer,
+		Recorder:   recorder,
+	}
+
+	missingUrl := testMsg
+	missingUrl.SubmissionUrl = ""
+
+	tests := []struct {
+		name   string
+		record events.SNSEventRecord
+		reason string
+	}{
+		{name: "missing field", record: testRecord(t, missingUrl), reason: "SubmissionUrl"},
+		{name: "not json", record: events.SNSEventRecord{SNS: events.SNSEntity{MessageID: "sns-2", Message: "{oops"}}, reason: "unparseable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder.deadLetters = nil
+			result := p.ProcessRecord(context.Background(), tt.record)
+
+			if result.MailStatus != StatusInvalidMessage {
+				t.Errorf("MailStatus = %s, want %s", result.MailStatus, StatusInvalidMessage)
+			}
+			if mailer.recipient != "" {
+				t.Errorf("mail sent for invalid message")
+			}
+			if len(recorder.deadLetters) != 1 || !strings.Contains(recorder.deadLetters[0].Reason, tt.reason) {
+				t.Errorf("dead letters = %+v", recorder.deadLetters)
+			}
+			if recorder.deadLetters[0].RawMessage != tt.record.SNS.Message {
+				t.Errorf("raw message = %q", recorder.deadLetters[0].RawMessage)
+			}
+		})
+	}
+}
+
+func TestProcessRecordDuplicate(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+
+	uploader := &fakeUploader{}
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   uploader,
+		Mailer:     &fakeMailer{},
+		Recorder:   recorder,
+	}
+
+	p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+	result := p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+	if result.MailStatus != StatusDuplicate {
+		t.Errorf("MailStatus = %s, want %s", result.MailStatus, StatusDuplicate)
+	}
+	if len(recorder.items) != 1 {
+		t.Errorf("recorded %d items, want 1", len(recorder.items))
+	}
+}
+
+func TestProcessRecordFailureCc(t *testing.T) {
+	t.Setenv("MAIL_CC", "ta@example.com, course@example.com")
+	t.Setenv("MAIL_BCC", "audit@example.com")
+
+	tests := []struct {
+		name        string
+		downloadErr error
+		wantCc      []string
+		wantBcc     []string
+	}{
+		{name: "success", wantCc: nil, wantBcc: nil},
+		{name: "failure", downloadErr: errors.New("Not a zip file"), wantCc: []string{"ta@example.com", "course@example.com"}, wantBcc: []string{"audit@example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer := &fakeMailer{}
+			p := &Processor{
+				Downloader: &fakeDownloader{body: "PK\x03\x04data", err: tt.downloadErr},
+				Uploader:   &fakeUploader{},
+				Mailer:     mailer,
+				Recorder:   &fakeRecorder{},
+			}
+
+			p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+			if strings.Join(mailer.email.Cc, ",") != strings.Join(tt.wantCc, ",") {
+				t.Errorf("Cc = %v, want %v", mailer.email.Cc, tt.wantCc)
+			}
+			if strings.Join(mailer.email.Bcc, ",") != strings.Join(tt.wantBcc, ",") {
+				t.Errorf("Bcc = %v, want %v", mailer.email.Bcc, tt.wantBcc)
+			}
+			if len(mailer.email.To) != 1 || mailer.email.To[0] != testMsg.SubmissionEmail {
+				t.Errorf("To = %v", mailer.email.To)
+			}
+		})
+	}
+}
+
+func TestProcessRecordNotifyOnSuccess(t *testing.T) {
+	t.Setenv("NOTIFY_ON_SUCCESS", "false")
+
+	tests := []struct {
+		name        string
+		downloadErr error
+		wantMailed  bool
+	}{
+		{name: "success skipped", wantMailed: false},
+		{name: "failure still sent", downloadErr: errors.New("Not a zip file"), wantMailed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer := &fakeMailer{}
+			recorder := &fakeRecorder{}
+			p := &Processor{
+				Downloader: &fakeDownloader{body: "PK\x03\x04data", err: tt.downloadErr},
+				Uploader:   &fakeUploader{},
+				Mailer:     mailer,
+				Recorder:   recorder,
+			}
+
+			result := p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+			if mailed := mailer.recipient != ""; mailed != tt.wantMailed {
+				t.Errorf("mailed = %v, want %v", mailed, tt.wantMailed)
+			}
+			if result.MailSkipped == tt.wantMailed {
+				t.Errorf("MailSkipped = %v, want %v", result.MailSkipped, !tt.wantMailed)
+			}
+			if len(recorder.items) != 1 {
+				t.Fatalf("recorded %d items, want 1", len(recorder.items))
+			}
+			item := recorder.items[0]
+			if item.IsMailSent != tt.wantMailed || item.MailSkipped == tt.wantMailed {
+				t.Errorf("IsMailSent = %v, MailSkipped = %v", item.IsMailSent, item.MailSkipped)
+			}
+		})
+	}
+}
+
+func TestProcessRecordInsufficientTime(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("UPLOAD_MIN_REMAINING_MS", "60000")
+
+	mailer := &fakeMailer{}
+	uploader := &fakeUploader{}
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   uploader,
+		Mailer:     mailer,
+		Recorder:   recorder,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result := p.ProcessRecord(ctx, testRecord(t, testMsg))
+
+	if result.Failure == nil || result.Failure.Reason != "insufficient_time" || !result.retryable {
+		t.Fatalf("Failure = %+v, retryable = %v", result.Failure, result.retryable)
+	}
+	if uploader.key != "" || mailer.recipient != "" {
+		t.Errorf("uploaded %q and mailed %q, want neither", uploader.key, mailer.recipient)
+	}
+	if len(recorder.released) != 1 {
+		t.Errorf("released = %v, want the claim dropped for the retry", recorder.released)
+	}
+
+	t.Setenv("UPLOAD_MIN_REMAINING_MS", "1000")
+	if err := checkRemainingTime(ctx); err != nil {
+		t.Errorf("checkRemainingTime() = %v with time to spare", err)
+	}
+	if err := checkRemainingTime(context.Background()); err != nil {
+		t.Errorf("checkRemainingTime() = %v without a deadline", err)
+	}
+}
+
+func TestProcessRecordNotifiers(t *testing.T) {
+	var got NotificationEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+	}))
+	defer srv.Close()
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no_service", http.StatusNotFound)
+	}))
+	defer slack.Close()
+
+	t.Setenv("NOTIFIER", "webhook, slack")
+	t.Setenv("NOTIFY_WEBHOOK_URL", srv.URL)
+	t.Setenv("SLACK_WEBHOOK_URL", slack.URL)
+	mail, notifiers, err := notifiersFromEnv()
+	if err != nil || mail || len(notifiers) != 2 {
+		t.Fatalf("notifiersFromEnv() = %v, %d notifiers, %v", mail, len(notifiers), err)
+	}
+
+	mailer := &fakeMailer{}
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader:   &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:     &fakeUploader{},
+		Mailer:       mailer,
+		Recorder:     recorder,
+		Notifiers:    notifiers,
+		MailDisabled: !mail,
+	}
+
+	result := p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+	if result.MailStatus != StatusSuccess || !result.MailSkipped || mailer.recipient != "" {
+		t.Errorf("MailStatus = %v, MailSkipped = %v, mailed %q", result.MailStatus, result.MailSkipped, mailer.recipient)
+	}
+	if got.Status != StatusSuccess || got.SubmissionId != testMsg.SubmissionId || got.Path == "" {
+		t.Errorf("webhook event = %+v", got)
+	}
+	if len(recorder.items) != 1 {
+		t.Fatalf("recorded %d items, want 1", len(recorder.items))
+	}
+	outcomes := recorder.items[0].Notifications
+	if len(outcomes) != 2 || outcomes[0] != (NotifierOutcome{Name: "webhook", Ok: true}) {
+		t.Fatalf("Notifications = %+v", outcomes)
+	}
+	if outcomes[1].Name != "slack" || outcomes[1].Ok || !strings.Contains(outcomes[1].Error, "404") {
+		t.Errorf("slack outcome = %+v", outcomes[1])
+	}
+
+	t.Setenv("NOTIFIER", "mailgun,pager")
+	if _, _, err := notifiersFromEnv(); err == nil {
+		t.Error("notifiersFromEnv() accepted an unknown notifier")
+	}
+}
+
+func TestProcessRecordFallbackMail(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+
+	var mu sync.Mutex
+	var posted []FallbackEmail
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var email FallbackEmail
+		json.NewDecoder(r.Body).Decode(&email)
+		posted = append(posted, email)
+		if fail {
+			http.Error(w, "down too", http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name            string
+		mailErr         error
+		fallbackFails   bool
+		wantPosts       int
+		wantDeliveredBy string
+		wantSent        bool
+		wantReason      string
+	}{
+		{name: "mailgun delivers", wantDeliveredBy: "mailgun", wantSent: true},
+		{name: "fallback delivers", mailErr: errors.New("503 from Mailgun"), wantPosts: 1, wantDeliveredBy: "webhook", wantSent: true},
+		{name: "all fail", mailErr: errors.New("503 from Mailgun"), fallbackFails: true, wantPosts: 1, wantDeliveredBy: "none", wantReason: "send_failed"},
+		{name: "invalid recipient", mailErr: ErrInvalidRecipient, wantDeliveredBy: "none", wantReason: "invalid_recipient"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			posted, fail = nil, tt.fallbackFails
+			mu.Unlock()
+			recorder := &fakeRecorder{}
+			p := &Processor{
+				Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+				Uploader:   &fakeUploader{},
+				Mailer:     &fakeMailer{err: tt.mailErr},
+				Recorder:   recorder,
+				Fallback:   webhookMailer{url: srv.URL},
+			}
+
+			result := p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+			if len(posted) != tt.wantPosts {
+				t.Fatalf("fallback got %d posts, want %d", len(posted), tt.wantPosts)
+			}
+			if tt.wantPosts > 0 && (!reflect.DeepEqual(posted[0].To, []string{testMsg.SubmissionEmail}) || !strings.Contains(posted[0].Body, testMsg.AssignmentId)) {
+				t.Errorf("posted = %+v", posted[0])
+			}
+			item := recorder.items[0]
+			if item.DeliveredBy != tt.wantDeliveredBy || item.IsMailSent != tt.wantSent || result.UnnotifiedUpload == tt.wantSent {
+				t.Errorf("DeliveredBy = %q, IsMailSent = %v, UnnotifiedUpload = %v", item.DeliveredBy, item.IsMailSent, result.UnnotifiedUpload)
+			}
+			if tt.wantReason == "" && result.Failure != nil || tt.wantReason != "" && (result.Failure == nil || result.Failure.Reason != tt.wantReason) {
+				t.Errorf("Failure = %+v, want reason %q", result.Failure, tt.wantReason)
+			}
+			if tt.wantPosts > 0 && (len(item.Notifications) < 2 || item.Notifications[1].Name != "webhook" || item.Notifications[1].Ok == tt.fallbackFails) {
+				t.Errorf("Notifications = %+v", item.Notifications)
+			}
+		})
+	}
+}
+
+func TestProcessRecordRecentSubmissions(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	recorder := &fakeRecorder{}
+	uploader := &fakeUploader{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   uploader,
+		Mailer:     &fakeMailer{},
+		Recorder:   recorder,
+		Recent:     newRecentSubmissions(2),
+	}
+
+	if result := p.ProcessRecord(context.Background(), testRecord(t, testMsg)); result.MailStatus != StatusSuccess {
+		t.Fatalf("first delivery MailStatus = %v", result.MailStatus)
+	}
+	// Forgetting the claim shows the duplicate is caught before the table.
+	recorder.claimed = nil
+	result := p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+	if result.MailStatus != StatusDuplicate || result.DedupedBy != "cache" {
+		t.Errorf("duplicate MailStatus = %v, DedupedBy = %q", result.MailStatus, result.DedupedBy)
+	}
+
+	// A retryable failure drops the cache entry with the claim.
+	msg := testMsg
+	msg.SubmissionId = "sub-retry"
+	uploader.err = errors.New("503 from GCS")
+	p.ProcessRecord(context.Background(), testRecord(t, msg))
+	uploader.err = nil
+	if result := p.ProcessRecord(context.Background(), testRecord(t, msg)); result.MailStatus != StatusSuccess {
+		t.Errorf("redelivery after a retryable failure MailStatus = %v, DedupedBy = %q", result.MailStatus, result.DedupedBy)
+	}
+}
+
+func TestProcessRecordTargetBucket(t *testing.T) {
+	t.Setenv("BUCKET", "submissions")
+	t.Setenv("ALLOWED_BUCKETS", "submissions-cs101, submissions-cs102")
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus MailStatus
+		wantBucket string
+	}{
+		{name: "default", wantStatus: StatusSuccess, wantBucket: "submissions"},
+		{name: "allowed", target: "submissions-cs102", wantStatus: StatusSuccess, wantBucket: "submissions-cs102"},
+		{name: "not allowed", target: "attacker-bucket", wantStatus: StatusInvalidMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploader := &fakeUploader{}
+			mailer := &fakeMailer{}
+			recorder := &fakeRecorder{}
+			p := &Processor{
+				Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+				Uploader:   uploader,
+				Mailer:     mailer,
+				Recorder:   recorder,
+			}
+			msg := testMsg
+			msg.TargetBucket = tt.target
+
+			result := p.ProcessRecord(context.Background(), testRecord(t, msg))
+
+			if result.MailStatus != tt.wantStatus {
+				t.Fatalf("MailStatus = %v, want %v (%s)", result.MailStatus, tt.wantStatus, result.Error)
+			}
+			if uploader.bucket != tt.wantBucket {
+				t.Errorf("uploaded to %q, want %q", uploader.bucket, tt.wantBucket)
+			}
+			if tt.wantBucket == "" {
+				if result.Failure == nil || result.Failure.Reason != "bucket_not_allowed" {
+					t.Errorf("Failure = %+v", result.Failure)
+				}
+				return
+			}
+			if item := recorder.items[0]; item.Bucket != tt.wantBucket {
+				t.Errorf("item Bucket = %q, want %q", item.Bucket, tt.wantBucket)
+			}
+			if !strings.Contains(mailer.body, "gs://"+tt.wantBucket+"/") {
+				t.Errorf("mail body %q does not name the bucket", mailer.body)
+			}
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	t.Setenv("BUCKET", "submissions")
+	// There is no SNS signature to check, so this must not reject the message.
+	t.Setenv("VERIFY_SNS_SIGNATURE", "true")
+
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   recorder,
+	}
+	result, err := p.Process(context.Background(), testMsg)
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if result.MailStatus != StatusSuccess || !result.Uploaded || result.MessageId == "" {
+		t.Errorf("result = %+v", result)
+	}
+	if len(recorder.items) != 1 || recorder.items[0].MessageId != result.MessageId {
+		t.Errorf("items = %+v, want one for message %s", recorder.items, result.MessageId)
+	}
+
+	p.Downloader = &fakeDownloader{err: ErrFileTooLarge}
+	msg := testMsg
+	msg.SubmissionId = "sub-2"
+	result, err = p.Process(context.Background(), msg)
+	var perr *PipelineError
+	if !errors.As(err, &perr) || perr.Reason != "file_too_large" || result.MailStatus != StatusFileTooLarge {
+		t.Errorf("Process() = %+v, %v, want a file_too_large failure", result, err)
+	}
+}
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func useFakeClock(t *testing.T, now time.Time) *fakeClock {
+	t.Helper()
+	c := &fakeClock{now: now}
+	clock = c
+	t.Cleanup(func() { clock = systemClock{} })
+	return c
+}
+
+// slowDownloader serves a zip after moving the clock on by d.
+type slowDownloader struct {
+	clock *fakeClock
+	d     time.Duration
+}
+
+func (d slowDownloader) Download(ctx context.Context, url string) (io.ReadCloser, error) {
+	d.clock.Advance(d.d)
+	return io.NopCloser(strings.NewReader("PK\x03\x04data")), nil
+}
+
+func TestProcessRecordTiming(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	c := useFakeClock(t, time.Date(2023, 11, 20, 10, 0, 0, 0, time.UTC))
+
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: slowDownloader{clock: c, d: 1500 * time.Millisecond},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   recorder,
+	}
+	p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+	item := recorder.items[0]
+	if item.ProcessedAt != "2023-11-20T10:00:01Z" {
+		t.Errorf("ProcessedAt = %q, want 2023-11-20T10:00:01Z", item.ProcessedAt)
+	}
+	if item.DownloadDurationMs != 1500 || item.UploadDurationMs != 0 || item.TotalDurationMs != 1500 {
+		t.Errorf("durations = %d/%d/%d, want 1500/0/1500", item.DownloadDurationMs, item.UploadDurationMs, item.TotalDurationMs)
+	}
+}
+
+func TestPrepareItemTTL(t *testing.T) {
+	t.Setenv("RECORD_TTL_DAYS", "30")
+	now := time.Date(2023, 11, 20, 10, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+
+	item := prepareItem(context.Background(), Item{SubmissionId: "sub-1", MailgunId: "<id@mailgun>"})
+	if want := now.AddDate(0, 0, 30).Unix(); item.ExpiresAt != want {
+		t.Errorf("ExpiresAt = %d, want %d", item.ExpiresAt, want)
+	}
+	if want := now.Format(recordIdTimeLayout) + "#<id@mailgun>"; item.RecordId != want {
+		t.Errorf("RecordId = %q, want %q", item.RecordId, want)
+	}
+}
+
+func TestLengthLimits(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{s: "short", max: 10, want: "short"},
+		{s: "exactly10!", max: 10, want: "exactly10!"},
+		{s: "a longer string", max: 8, want: "a longe…"},
+		{s: "ñandú über", max: 5, want: "ñand…"},
+		{s: "unlimited", max: 0, want: "unlimited"},
+	} {
+		if got := ellipsize(tt.s, tt.max); got != tt.want {
+			t.Errorf("ellipsize(%q, %d) = %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+	}
+
+	t.Setenv("MAIL_BODY_MAX_CHARS", "60")
+	body := GenerateBody(StatusDownloadFailed, testMsg, "", BodyOptions{})
+	if utf8.RuneCountInString(body) != 60 || !strings.HasSuffix(body, "…") {
+		t.Errorf("body = %q, want 60 characters ending in an ellipsis", body)
+	}
+	if html, err := GenerateHTMLBody(StatusDownloadFailed, testMsg, "", BodyOptions{}); err == nil || html != "" {
+		t.Errorf("GenerateHTMLBody() = %q, %v, want an error for a body over the limit", html, err)
+	}
+
+	t.Setenv("RECORD_FIELD_MAX_CHARS", "16")
+	huge := strings.Repeat("x", 100000)
+	item := prepareItem(context.Background(), Item{SubmissionId: "sub-1", Response: huge, Error: huge, MailError: huge, Failure: &PipelineError{Stage: StageMail, Reason: "send_failed", Message: huge}})
+	for name, got := range map[string]string{"Response": item.Response, "Error": item.Error, "MailError": item.MailError, "Failure.Message": item.Failure.Message} {
+		if got != strings.Repeat("x", 15)+"…" {
+			t.Errorf("%s = %q, want it cut to 16 characters", name, got)
+		}
+	}
+}
+
+// useFakeDynamo points the shared DynamoDB client at handler.
+func useFakeDynamo(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	t.Setenv("DYNAMODB_ENDPOINT", srv.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	reset := func() {
+		awsSessionOnce, awsSession = sync.Once{}, nil
+		dynamoOnce, dynamoClient = sync.Once{}, nil
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// putItemRequests records the PutItem calls a fake DynamoDB receives.
+type putItemRequests struct {
+	mu    sync.Mutex
+	calls []dynamodb.PutItemInput
+}
+
+func (p *putItemRequests) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") == "DynamoDB_20120810.PutItem" {
+			var in dynamodb.PutItemInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				t.Errorf("decoding PutItem: %v", err)
+			}
+			p.mu.Lock()
+			p.calls = append(p.calls, in)
+			p.mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		io.WriteString(w, `{}`)
+	}
+}
+
+func TestInsertToDynamo(t *testing.T) {
+	t.Setenv("MAIL_TABLE", "mail")
+	requests := &putItemRequests{}
+	useFakeDynamo(t, requests.handler(t))
+
+	InsertToDynamo(context.Background(), Item{SubmissionId: "sub-1", MessageId: "sns-1", MailgunId: "<id@mailgun>"})
+	InsertToDynamo(context.Background(), Item{SubmissionId: "sub-1", MessageId: "sns-2"})
+
+	if len(requests.calls) != 2 {
+		t.Fatalf("got %d PutItem calls, want 2", len(requests.calls))
+	}
+	timestamp := `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{9}Z#`
+	wantRecordId := []*regexp.Regexp{
+		regexp.MustCompile(`^` + timestamp + `<id@mailgun>$`),
+		regexp.MustCompile(`^` + timestamp + `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`),
+	}
+	for i, in := range requests.calls {
+		if got := aws.StringValue(in.TableName); got != "mail" {
+			t.Errorf("call %d: TableName = %q", i, got)
+		}
+		if got := aws.StringValue(in.Item["SubmissionId"].S); got != "sub-1" {
+			t.Errorf("call %d: SubmissionId = %q, want sub-1", i, got)
+		}
+		if got := aws.StringValue(in.Item["RecordId"].S); !wantRecordId[i].MatchString(got) {
+			t.Errorf("call %d: RecordId = %q, want it to match %s", i, got, wantRecordId[i])
+		}
+		if got := aws.StringValue(in.ConditionExpression); got != "attribute_not_exists(#sk)" {
+			t.Errorf("call %d: ConditionExpression = %q", i, got)
+		}
+		if got := aws.StringValue(in.ExpressionAttributeNames["#sk"]); got != "RecordId" {
+			t.Errorf("call %d: #sk = %q, want RecordId", i, got)
+		}
+	}
+}
+
+func TestInvalidMessageFiledUnderMessageId(t *testing.T) {
+	t.Setenv("MAIL_TABLE", "mail")
+	t.Setenv("DEAD_LETTER_TABLE", "")
+	requests := &putItemRequests{}
+	useFakeDynamo(t, requests.handler(t))
+
+	p := &Processor{Recorder: dynamoRecorder{}}
+	record := events.SNSEventRecord{SNS: events.SNSEntity{MessageID: "sns-bad", Message: "not json"}}
+	if result := p.ProcessRecord(context.Background(), record); result.MailStatus != StatusInvalidMessage {
+		t.Fatalf("MailStatus = %v, want %v", result.MailStatus, StatusInvalidMessage)
+	}
+
+	if len(requests.calls) != 1 {
+		t.Fatalf("got %d PutItem calls, want 1", len(requests.calls))
+	}
+	item := requests.calls[0].Item
+	if got := aws.StringValue(item["SubmissionId"].S); got != "sns-bad" {
+		t.Errorf("SubmissionId = %q, want the SNS message id", got)
+	}
+	if item["DeadLetter"] == nil || !aws.BoolValue(item["DeadLetter"].BOOL) {
+		t.Errorf("DeadLetter = %v, want true", item["DeadLetter"])
+	}
+}
+
+func TestPutVersionedItem(t *testing.T) {
+	t.Setenv("MAIL_TABLE", "mail")
+
+	// The fake table holds one submission's item and applies the two
+	// conditions PutVersionedItem uses.
+	var mu sync.Mutex
+	stored := int64(0)
+	var recordIds []string
+	useFakeDynamo(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var req struct {
+			Item                      map[string]*dynamodb.AttributeValue
+			ConditionExpression       string
+			ExpressionAttributeValues map[string]*dynamodb.AttributeValue
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.GetItem":
+			if stored == 0 {
+				io.WriteString(w, `{}`)
+				return
+			}
+			fmt.Fprintf(w, `{"Item": {"Version": {"N": "%d"}}}`, stored)
+		case "DynamoDB_20120810.PutItem":
+			ok := stored == 0
+			if v := req.ExpressionAttributeValues[":v"]; v != nil {
+				ok = aws.StringValue(v.N) == strconv.FormatInt(stored, 10)
+			}
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"__type": "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException", "message": "The conditional request failed"}`)
+				return
+			}
+			recordIds = append(recordIds, aws.StringValue(req.Item["RecordId"].S))
+			stored, _ = strconv.ParseInt(aws.StringValue(req.Item["Version"].N), 10, 64)
+			io.WriteString(w, `{}`)
+		default:
+			http.Error(w, "unexpected "+r.Header.Get("X-Amz-Target"), http.StatusBadRequest)
+		}
+	})
+	ctx := context.Background()
+
+	// Without a version the next one is taken at write time.
+	if err := PutVersionedItem(ctx, Item{SubmissionId: "sub-1"}); err != nil || stored != 1 {
+		t.Fatalf("first write: err = %v, stored version %d", err, stored)
+	}
+
+	// Two runs both read version 1; the one finishing second is stale.
+	current, err := versionedDynamoRecorder{}.ItemVersion(ctx, "sub-1")
+	if err != nil || current != 1 {
+		t.Fatalf("ItemVersion() = %d, %v, want 1", current, err)
+	}
+	if err := PutVersionedItem(ctx, Item{SubmissionId: "sub-1", Version: current + 1}); err != nil {
+		t.Fatalf("second write: %v", err)
+	}
+	if err := PutVersionedItem(ctx, Item{SubmissionId: "sub-1", Version: current + 1}); !errors.Is(err, ErrStaleWrite) {
+		t.Errorf("concurrent write: err = %v, want %v", err, ErrStaleWrite)
+	}
+	if stored != 2 {
+		t.Errorf("stored version = %d, want 2", stored)
+	}
+	if want := []string{latestRecordId, latestRecordId}; !reflect.DeepEqual(recordIds, want) {
+		t.Errorf("RecordIds = %q, want %q", recordIds, want)
+	}
+}
+
+func TestNewDynamoHTTPClient(t *testing.T) {
+	t.Setenv("DYNAMODB_MAX_IDLE_CONNS_PER_HOST", "8")
+	t.Setenv("DYNAMODB_HTTP_TIMEOUT_MS", "2500")
+
+	client := newDynamoHTTPClient()
+	tr := client.Transport.(*http.Transport)
+	if tr.MaxIdleConns != 32 {
+		t.Errorf("MaxIdleConns = %d, want the default 32", tr.MaxIdleConns)
+	}
+	if tr.MaxIdleConnsPerHost != 8 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 8", tr.MaxIdleConnsPerHost)
+	}
+	if tr.IdleConnTimeout != 30*time.Second {
+		t.Errorf("IdleConnTimeout = %v, want 30s", tr.IdleConnTimeout)
+	}
+	if client.Timeout != 2500*time.Millisecond {
+		t.Errorf("Timeout = %v, want 2.5s", client.Timeout)
+	}
+
+	// The client is the one the shared DynamoDB client sends with.
+	var mu sync.Mutex
+	conns := map[string]bool{}
+	useFakeDynamo(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		fmt.Fprint(w, `{}`)
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := getDynamoClient().GetItemWithContext(context.Background(), &dynamodb.GetItemInput{TableName: aws.String("mail"), Key: map[string]*dynamodb.AttributeValue{"SubmissionId": {S: aws.String("s")}}}); err != nil {
+			t.Fatalf("GetItem: %v", err)
+		}
+	}
+	if len(conns) != 1 {
+		t.Errorf("sequential calls used %d connections, want 1", len(conns))
+	}
+	if got := getDynamoClient().Config.HTTPClient.Timeout; got != 2500*time.Millisecond {
+		t.Errorf("DynamoDB client timeout = %v, want 2.5s", got)
+	}
+}
+
+// versionRecorder is a fakeRecorder whose items are at version.
+type versionRecorder struct {
+	*fakeRecorder
+	version int64
+}
+
+func (r versionRecorder) ItemVersion(ctx context.Context, submissionId string) (int64, error) {
+	return r.version, nil
+}
+
+func TestProcessRecordItemVersion(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   versionRecorder{fakeRecorder: recorder, version: 4},
+	}
+	p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+	if got := recorder.items[0].Version; got != 5 {
+		t.Errorf("Version = %d, want 5, one past the version read before processing", got)
+	}
+}
+
+// tokenRecorder adds mail token tracking to fakeRecorder.
+type tokenRecorder struct {
+	*fakeRecorder
+	sent map[string]bool
+}
+
+func (r *tokenRecorder) ClaimMailToken(ctx context.Context, token, submissionId string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sent[token]; ok {
+		return false, nil
+	}
+	r.sent[token] = false
+	return true, nil
+}
+
+func (r *tokenRecorder) SettleMailToken(ctx context.Context, token string, sent bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sent {
+		r.sent[token] = true
+	} else {
+		delete(r.sent, token)
+	}
+}
+
+func TestProcessRecordMailToken(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	recorder := &tokenRecorder{fakeRecorder: &fakeRecorder{}, sent: map[string]bool{}}
+	mailer := &fakeMailer{err: errors.New("mailgun down")}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   &fakeUploader{},
+		Mailer:     mailer,
+		Recorder:   recorder,
+	}
+	deliver := func() RecordResult {
+		recorder.claimed = nil
+		return p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+	}
+
+	// A failed send leaves the token free for the retry.
+	if result := deliver(); result.MailSent || result.MailDeduped {
+		t.Fatalf("MailSent = %v, MailDeduped = %v", result.MailSent, result.MailDeduped)
+	}
+	mailer.err = nil
+	if result := deliver(); !result.MailSent {
+		t.Fatalf("retry MailSent = false, error %q", result.Error)
+	}
+	if got := mailer.email.Headers["X-Idempotency-Token"]; got != MailToken(testMsg.SubmissionId, StatusSuccess) {
+		t.Errorf("X-Idempotency-Token = %q", got)
+	}
+	result := deliver()
+	if result.MailSent || !result.MailSkipped || !result.MailDeduped {
+		t.Errorf("second success MailSent = %v, MailSkipped = %v, MailDeduped = %v", result.MailSent, result.MailSkipped, result.MailDeduped)
+	}
+
+	token := MailToken(testMsg.SubmissionId, StatusSuccess)
+	if got := recorder.items[1].MailToken; got != token {
+		t.Errorf("item MailToken = %q, want %q", got, token)
+	}
+	if MailToken(testMsg.SubmissionId, StatusUploadFailed) == token {
+		t.Error("different outcomes share a mail token")
+	}
+}
+
+func TestRecentSubmissionsEviction(t *testing.T) {
+	c := newRecentSubmissions(2)
+	for _, id := range []string{"a", "b", "a", "c"} {
+		c.Add(id)
+	}
+	// b is the least recently used once a is seen again.
+	if c.Add("a") || c.Add("c") {
+		t.Error("recent ids were evicted")
+	}
+	if !c.Add("b") {
+		t.Error("least recently used id was kept")
+	}
+
+	var nilCache *recentSubmissions
+	if !nilCache.Add("a") || !nilCache.Add("a") {
+		t.Error("a disabled cache reported a duplicate")
+	}
+}
+
+func TestProcessRecordInlineData(t *testing.T) {
+	t.Setenv("MAX_DOWNLOAD_BYTES", "16")
+	t.Setenv("MIN_DOWNLOAD_BYTES", "6")
+
+	tests := []struct {
+		name       string
+		data       string
+		wantStatus MailStatus
+		wantReason string
+	}{
+		{name: "zip", data: base64.StdEncoding.EncodeToString([]byte("PK\x03\x04data")), wantStatus: StatusSuccess},
+		{name: "not base64", data: "PK!!", wantStatus: StatusDownloadFailed, wantReason: "invalid_data"},
+		{name: "not a zip", data: base64.StdEncoding.EncodeToString([]byte("<html>")), wantStatus: StatusNotZip, wantReason: "not_zip"},
+		{name: "too large", data: base64.StdEncoding.EncodeToString([]byte("PK\x03\x04" + strings.Repeat("x", 32))), wantStatus: StatusFileTooLarge, wantReason: "file_too_large"},
+		{name: "too small", data: base64.StdEncoding.EncodeToString([]byte("PK\x03\x04")), wantStatus: StatusFileTooSmall, wantReason: "file_too_small"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploader := &fakeUploader{}
+			p := &Processor{
+				// Inline data takes precedence, so the URL must not be fetched.
+				Downloader: &fakeDownloader{err: errors.New("downloaded despite inline data")},
+				Uploader:   uploader,
+				Mailer:     &fakeMailer{},
+				Recorder:   &fakeRecorder{},
+			}
+			msg := testMsg
+			msg.SubmissionData = tt.data
+
+			result := p.ProcessRecord(context.Background(), testRecord(t, msg))
+
+			if result.MailStatus != tt.wantStatus {
+				t.Errorf("MailStatus = %s, want %s (%s)", result.MailStatus, tt.wantStatus, result.Error)
+			}
+			if tt.wantReason != "" && (result.Failure == nil || result.Failure.Reason != tt.wantReason) {
+				t.Errorf("Failure = %+v, want reason %s", result.Failure, tt.wantReason)
+			}
+			if tt.wantStatus == StatusSuccess && uploader.uploaded != "PK\x03\x04data" {
+				t.Errorf("uploaded = %q", uploader.uploaded)
+			}
+		})
+	}
+}
+
+func TestHandleRequestRetryableError(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   &fakeUploader{err: errors.New("503 from GCS")},
+		Mailer:     &fakeMailer{},
+		Recorder:   &fakeRecorder{},
+	}
+
+	out, err := p.HandleRequest(context.Background(), events.SNSEvent{Records: []events.SNSEventRecord{testRecord(t, testMsg)}})
+	if err == nil {
+		t.Fatal("expected an error for a retryable upload failure")
+	}
+
+	var results []RecordResult
+	if err := json.Unmarshal([]byte(*out), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].MailStatus != StatusUploadFailed {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestHandleRequestEmptyEvent(t *testing.T) {
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   recorder,
+	}
+
+	for _, event := range []events.SNSEvent{{}, {Records: []events.SNSEventRecord{}}} {
+		out, err := p.HandleRequest(context.Background(), event)
+		if err != nil {
+			t.Fatalf("HandleRequest() error = %v", err)
+		}
+		if out == nil || *out != "[]" {
+			t.Errorf("HandleRequest() output = %v, want []", out)
+		}
+	}
+	if len(recorder.items) != 0 {
+		t.Errorf("recorded %d items for an empty event", len(recorder.items))
+	}
+}
+
+// panicDownloader panics for one URL and otherwise serves a zip.
+type panicDownloader struct {
+	url string
+}
+
+func (d panicDownloader) Download(ctx context.Context, url string) (io.ReadCloser, error) {
+	if url == d.url {
+		panic("unexpected message shape")
+	}
+	return io.NopCloser(strings.NewReader("PK\x03\x04data")), nil
+}
+
+func TestHandleRequestConcurrentBatch(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("MAX_CONCURRENCY", "3")
+
+	var records []events.SNSEventRecord
+	for i := 0; i < 8; i++ {
+		msg := testMsg
+		msg.SubmissionId = fmt.Sprintf("sub-%d", i)
+		msg.SubmissionUrl = fmt.Sprintf("https://example.com/%d.zip", i)
+		record := testRecord(t, msg)
+		record.SNS.MessageID = fmt.Sprintf("sns-%d", i)
+		records = append(records, record)
+	}
+
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: panicDownloader{url: "https://example.com/5.zip"},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   recorder,
+	}
+
+	out, err := p.HandleRequest(context.Background(), events.SNSEvent{Records: records})
+	if err == nil {
+		t.Error("expected an error for the panicking record")
+	}
+
+	var results []RecordResult
+	if err := json.Unmarshal([]byte(*out), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(records) {
+		t.Fatalf("got %d results, want %d", len(results), len(records))
+	}
+	for i, result := range results {
+		if want := fmt.Sprintf("sns-%d", i); result.MessageId != want {
+			t.Errorf("result %d MessageId = %q, want %q", i, result.MessageId, want)
+		}
+		if wantOk := i != 5; (result.MailStatus == StatusSuccess) != wantOk {
+			t.Errorf("result %d = %+v", i, result)
+		}
+	}
+	if len(recorder.items) != len(records) || recorder.batches != 1 {
+		t.Errorf("recorded %d items in %d batches, want %d in one", len(recorder.items), recorder.batches, len(records))
+	}
+	for _, item := range recorder.items {
+		if item.SubmissionId == "sub-5" && (item.Failure == nil || item.Failure.Reason != "panic") {
+			t.Errorf("panicking record item = %+v", item)
+		}
+	}
+	if strings.Join(recorder.released, ",") != "sub-5" {
+		t.Errorf("released = %v, want the panicking record's claim", recorder.released)
+	}
+}
+
+func TestHandleSQSRequest(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+
+	body := func(msg Structmsg) string {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	wrapped, raw, broken := testMsg, testMsg, testMsg
+	wrapped.SubmissionId = "sub-wrapped"
+	raw.SubmissionId = "sub-raw"
+	broken.SubmissionId, broken.SubmissionUrl = "sub-broken", "https://example.com/broken.zip"
+	notification, err := json.Marshal(map[string]interface{}{
+		"Type":      "Notification",
+		"MessageId": "sns-wrapped",
+		"TopicArn":  "arn:aws:sns:us-east-1:123456789012:submissions",
+		"Message":   body(wrapped),
+		"Timestamp": "2023-11-20T10:00:00.000Z",
+		"MessageAttributes": map[string]interface{}{
+			"correlationId": map[string]interface{}{"Type": "String", "Value": "corr-wrapped"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	correlation := "corr-raw"
+
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: panicDownloader{url: broken.SubmissionUrl},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   recorder,
+	}
+	resp, err := p.HandleSQSRequest(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "sqs-1", Body: string(notification)},
+		{MessageId: "sqs-2", Body: body(raw), MessageAttributes: map[string]events.SQSMessageAttribute{
+			"correlationId": {DataType: "String", StringValue: &correlation},
+		}},
+		{MessageId: "sqs-3", Body: body(broken)},
+	}})
+	if err != nil {
+		t.Fatalf("HandleSQSRequest() error = %v", err)
+	}
+
+	if want := []events.SQSBatchItemFailure{{ItemIdentifier: "sqs-3"}}; !reflect.DeepEqual(resp.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %+v, want %+v", resp.BatchItemFailures, want)
+	}
+	got := map[string]Item{}
+	for _, item := range recorder.items {
+		got[item.SubmissionId] = item
+	}
+	if item := got["sub-wrapped"]; item.MessageId != "sns-wrapped" || item.CorrelationId != "corr-wrapped" || !item.IsUploaded {
+		t.Errorf("wrapped item = %+v", item)
+	}
+	if item := got["sub-raw"]; item.MessageId != "sqs-2" || item.CorrelationId != "corr-raw" || !item.IsUploaded {
+		t.Errorf("raw item = %+v", item)
+	}
+}
+
+// panicBatchRecorder panics writing a batch, after every record is done.
+type panicBatchRecorder struct {
+	*fakeRecorder
+}
+
+func (panicBatchRecorder) RecordBatch(ctx context.Context, items []Item) {
+	panic("batch write failed")
+}
+
+func TestHandleSQSRequestPanicAfterRecords(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+
+	first, second := testMsg, testMsg
+	first.SubmissionId, second.SubmissionId = "sub-1", "sub-2"
+	b1, _ := json.Marshal(first)
+	b2, _ := json.Marshal(second)
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   panicBatchRecorder{recorder},
+	}
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "sqs-1", Body: string(b1)},
+		{MessageId: "sqs-2", Body: string(b2)},
+	}}
+
+	resp, err := p.HandleSQSRequest(context.Background(), event)
+	if err != nil {
+		t.Fatalf("HandleSQSRequest() error = %v", err)
+	}
+	// Both records were uploaded and mailed before the batch write panicked,
+	// so neither goes back to the queue.
+	if len(resp.BatchItemFailures) != 0 {
+		t.Errorf("BatchItemFailures = %+v, want none", resp.BatchItemFailures)
+	}
+	if len(recorder.items) != 2 || recorder.items[0].Failure == nil || recorder.items[0].Failure.Reason != "panic" {
+		t.Errorf("items = %+v, want a panic failure item per record", recorder.items)
+	}
+	for _, item := range recorder.items {
+		if item.Retryable {
+			t.Errorf("item for %s is Retryable, but the record will not be redelivered", item.SubmissionId)
+		}
+	}
+}
+
+// panicDigestMailer sends student mail but panics on the digest.
+type panicDigestMailer struct {
+	*fakeMailer
+}
+
+func (m panicDigestMailer) Send(ctx context.Context, email Email) (MailReceipt, error) {
+	if strings.HasPrefix(email.Subject, "Submission digest") {
+		panic("digest failed")
+	}
+	return m.fakeMailer.Send(ctx, email)
+}
+
+func TestProcessRecordsPanicAfterFlush(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("DIGEST_MODE", "batch")
+	t.Setenv("DIGEST_RECIPIENT", "ta@example.com")
+
+	first, second := testMsg, testMsg
+	first.SubmissionId, second.SubmissionId = "sub-1", "sub-2"
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   &fakeUploader{},
+		Mailer:     panicDigestMailer{&fakeMailer{}},
+		Recorder:   recorder,
+	}
+	records := []events.SNSEventRecord{testRecord(t, first), testRecord(t, second)}
+	records[1].SNS.MessageID = "sns-2"
+
+	results, err := p.processRecords(context.Background(), records)
+	if err == nil {
+		t.Fatal("processRecords() error = nil, want the digest panic")
+	}
+	for _, result := range results {
+		if result.MailStatus != StatusSuccess || result.retryable {
+			t.Errorf("result = %+v, want the record's own success", result)
+		}
+	}
+	// The batch was written before the digest panicked, so the success
+	// items are the only ones.
+	if recorder.batches != 1 || len(recorder.items) != 2 {
+		t.Fatalf("batches = %d, items = %+v, want one batch of 2", recorder.batches, recorder.items)
+	}
+	for _, item := range recorder.items {
+		if item.Failure != nil {
+			t.Errorf("item for %s has Failure %+v, want none", item.SubmissionId, item.Failure)
+		}
+	}
+}
+
+func TestBuildObjectKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		prefix  string
+		msg     Structmsg
+		want    string
+		wantErr bool
+	}{
+		{name: "default", msg: testMsg, want: "asg-1/user-1/sub-1"},
+		{name: "prefix", prefix: "fall2024/cs101/", msg: testMsg, want: "fall2024/cs101/asg-1/user-1/sub-1"},
+		{name: "messy prefix", prefix: "/fall2024//../cs101", msg: testMsg, want: "fall2024/__/cs101/asg-1/user-1/sub-1"},
+		{name: "custom", tmpl: "{UserId}/{SubmissionId}.zip", msg: testMsg, want: "user-1/sub-1.zip"},
+		{name: "traversal", msg: Structmsg{AssignmentId: "..", UserId: "../b", SubmissionId: "s\x00"}, want: "__/.._b/s"},
+		{name: "assignment type", tmpl: "{AssignmentType}/{SubmissionId}", msg: Structmsg{AssignmentType: "lab/1", SubmissionId: "sub-1"}, want: "lab_1/sub-1"},
+		{name: "unknown placeholder", tmpl: "{Course}/{SubmissionId}", msg: testMsg, wantErr: true},
+		{name: "empty key", tmpl: "/{UserId}/", msg: Structmsg{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OBJECT_PREFIX", tt.prefix)
+			got, err := BuildObjectKey(tt.tmpl, tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisplayPath(t *testing.T) {
+	t.Setenv("BUCKET", "submissions")
+	tests := []struct {
+		tmpl      string
+		signedURL string
+		want      string
+	}{
+		{tmpl: "", want: "gs://submissions/a1/u1/s1"},
+		{tmpl: "https://portal.example.edu/submissions/{Key}", want: "https://portal.example.edu/submissions/a1/u1/s1"},
+		{tmpl: "{SignedUrl}", signedURL: "https://signed.example/x", want: "https://signed.example/x"},
+		{tmpl: "{SignedUrl}", want: "gs://submissions/a1/u1/s1"},
+		{tmpl: "{Bucket}/{Path}", want: "gs://submissions/a1/u1/s1"},
+	}
+	for _, tt := range tests {
+		t.Setenv("PATH_DISPLAY_TEMPLATE", tt.tmpl)
+		if got := displayPath("submissions", "a1/u1/s1", tt.signedURL); got != tt.want {
+			t.Errorf("displayPath(%q, %q) = %q, want %q", tt.tmpl, tt.signedURL, got, tt.want)
+		}
+	}
+
+	if _, err := DisplayPath("{Bucket}/{Path}", "b", "k", ""); err == nil {
+		t.Error("DisplayPath() accepted an unknown placeholder")
+	}
+}
+
+func TestProcessRecordAttachment(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("ATTACH_SUBMISSION", "true")
+
+	tests := []struct {
+		name         string
+		maxBytes     string
+		wantAttached bool
+		wantLink     bool
+	}{
+		{name: "fits", maxBytes: "1024", wantAttached: true, wantLink: true},
+		{name: "too large", maxBytes: "4", wantLink: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ATTACHMENT_MAX_BYTES", tt.maxBytes)
+			mailer := &fakeMailer{}
+			p := &Processor{
+				Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+				Uploader:   &fakeUploader{},
+				Mailer:     mailer,
+				Recorder:   &fakeRecorder{},
+			}
+
+			p.ProcessRecord(context.Background(), testRecord(t, testMsg))
+
+			if got := mailer.email.Attachment != nil; got != tt.wantAttached {
+				t.Fatalf("attached = %v, want %v", got, tt.wantAttached)
+			}
+			if tt.wantAttached && string(mailer.email.Attachment.Data) != "PK\x03\x04data" {
+				t.Errorf("attachment data = %q", mailer.email.Attachment.Data)
+			}
+			if got := strings.Contains(mailer.body, "?signed"); got != tt.wantLink {
+				t.Errorf("link in body = %v, want %v", got, tt.wantLink)
+			}
+		})
+	}
+}
+
+func TestDownload(t *testing.T) {
+	t.Setenv("DOWNLOAD_ALLOW_PRIVATE", "true")
+	t.Setenv("DOWNLOAD_MAX_RETRIES", "1")
+	t.Setenv("DOWNLOAD_BACKOFF_MS", "1")
+	t.Setenv("MAX_DOWNLOAD_BYTES", "16")
+	t.Setenv("MIN_DOWNLOAD_BYTES", "6")
+
+	zip := "PK\x03\x04data"
+	var gz, zl, gzSmall bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	io.WriteString(gw, zip)
+	gw.Close()
+	gw = gzip.NewWriter(&gzSmall)
+	io.WriteString(gw, "PK")
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	io.WriteString(zw, zip)
+	zw.Close()
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		encoding    string
+		body        string
+		wantErr     error
+		wantAnyErr  bool
+	}{
+		{name: "zip", status: http.StatusOK, contentType: "application/zip", body: zip},
+		{name: "zip mixed case with parameters", status: http.StatusOK, contentType: "Application/Zip; charset=binary", body: zip},
+		{name: "octet-stream with parameters", status: http.StatusOK, contentType: "application/octet-stream; name=hw.zip", body: zip},
+		{name: "octet-stream with signature", status: http.StatusOK, contentType: "application/octet-stream", body: zip},
+		{name: "octet-stream without signature", status: http.StatusOK, contentType: "application/octet-stream", body: "<html>", wantErr: ErrNotZip},
+		{name: "html", status: http.StatusOK, contentType: "text/html", body: "<html>", wantErr: ErrNotZip},
+		{name: "not found", status: http.StatusNotFound, contentType: "application/zip", body: zip, wantErr: ErrUnreachable},
+		{name: "server error", status: http.StatusServiceUnavailable, contentType: "application/zip", wantAnyErr: true},
+		{name: "gzip encoded", status: http.StatusOK, contentType: "application/octet-stream", encoding: "gzip", body: gz.String()},
+		{name: "deflate encoded", status: http.StatusOK, contentType: "application/octet-stream", encoding: "deflate", body: zl.String()},
+		{name: "unsupported encoding", status: http.StatusOK, contentType: "application/zip", encoding: "br", body: zip, wantErr: errUnsupportedEncoding},
+		{name: "too large", status: http.StatusOK, contentType: "application/zip", body: zip + strings.Repeat("x", 32), wantErr: ErrFileTooLarge},
+		{name: "too small", status: http.StatusOK, contentType: "application/zip", body: "PK\x03\x04", wantErr: ErrFileTooSmall},
+		// The encoded size is above the minimum, so only the decoded body
+		// shows the file is too small.
+		{name: "too small gzip encoded", status: http.StatusOK, contentType: "application/zip", encoding: "gzip", body: gzSmall.String(), wantErr: ErrFileTooSmall},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			ctx, info := withDownloadInfo(context.Background())
+			body, err := Download(ctx, srv.URL)
+			if info.StatusCode != tt.status || info.ContentType != tt.contentType || info.FinalUrl != srv.URL {
+				t.Errorf("info = %+v", info)
+			}
+			if errors.Is(err, ErrNotZip) && !strings.Contains(err.Error(), tt.contentType) {
+				t.Errorf("err = %v, want the observed content type", err)
+			}
+			var got []byte
+			if err == nil {
+				defer body.Close()
+				got, err = io.ReadAll(body)
+			}
+			if err == nil && tt.encoding != "" && string(got) != zip {
+				t.Errorf("body = %q, want %q", got, zip)
+			}
+
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantAnyErr:
+				if err == nil {
+					t.Error("expected an error")
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadResolvedUrl(t *testing.T) {
+	t.Setenv("DOWNLOAD_ALLOW_PRIVATE", "true")
+	t.Setenv("MIN_DOWNLOAD_BYTES", "0")
+	t.Setenv("DOWNLOAD_MAX_RETRIES", "0")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/short":
+			http.Redirect(w, r, "/files/hw.zip", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "application/zip")
+			io.WriteString(w, "PK\x03\x04data")
+		}
+	}))
+	defer srv.Close()
+
+	ctx, info := withDownloadInfo(context.Background())
+	body, err := Download(ctx, srv.URL+"/short")
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	body.Close()
+	if info.FinalUrl != srv.URL+"/files/hw.zip" {
+		t.Errorf("FinalUrl = %q, want the redirect target", info.FinalUrl)
+	}
+
+	ctx, info = withDownloadInfo(context.Background())
+	if _, err := Download(ctx, srv.URL+"/loop"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("Download() error = %v, want %v", err, ErrTooManyRedirects)
+	}
+	if info.FinalUrl != srv.URL+"/loop" {
+		t.Errorf("FinalUrl = %q after a refused redirect", info.FinalUrl)
+	}
+}
+
+func TestDownloadRetriesAndThroughput(t *testing.T) {
+	t.Setenv("DOWNLOAD_ALLOW_PRIVATE", "true")
+	t.Setenv("MIN_DOWNLOAD_BYTES", "0")
+	t.Setenv("DOWNLOAD_MAX_RETRIES", "3")
+	t.Setenv("DOWNLOAD_BACKOFF_MS", "1")
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		io.WriteString(w, "PK\x03\x04data")
+	}))
+	defer srv.Close()
+
+	ctx, info := withDownloadInfo(context.Background())
+	body, err := Download(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	body.Close()
+	if info.Retries != 1 {
+		t.Errorf("Retries = %d, want 1", info.Retries)
+	}
+
+	if got := (stageTimings{FileSizeBytes: 3000, DownloadDurationMs: 500, UploadDurationMs: 1000}).bytesPerSec(); got != 2000 {
+		t.Errorf("bytesPerSec() = %d, want 2000", got)
+	}
+
+	// Both are kept when zero so every item can be aggregated.
+	av, err := marshalItem(Item{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"DownloadRetries", "DownloadBytesPerSec"} {
+		if av[name] == nil || aws.StringValue(av[name].N) != "0" {
+			t.Errorf("%s = %v, want 0", name, av[name])
+		}
+	}
+}
+
+func TestValidateZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.Create("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "package main")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.String()
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr error
+	}{
+		{name: "valid", body: valid},
+		{name: "truncated", body: valid[:len(valid)/2], wantErr: ErrCorruptZip},
+		{name: "signature only", body: "PK\x03\x04data", wantErr: ErrCorruptZip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ValidateZip(strings.NewReader(tt.body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, _ := io.ReadAll(r)
+			if string(got) != tt.body {
+				t.Errorf("validated reader returned %d bytes, want %d", len(got), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestManifestTransform(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"hw/main.go", manifestName} {
+		w, _ := zw.Create(name)
+		io.WriteString(w, "package main")
+	}
+	zw.Close()
+
+	transform, err := transformFor("add-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := transform.Apply(context.Background(), testMsg, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	out, _ := io.ReadAll(r)
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatalf("transformed zip does not open: %v", err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "hw/main.go" || zr.File[1].Name != manifestName {
+		t.Fatalf("entries = %v", zr.File)
+	}
+
+	f, _ := zr.File[1].Open()
+	defer f.Close()
+	var manifest SubmissionManifest
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SubmissionId != testMsg.SubmissionId || manifest.Files != 1 || manifest.OriginalSizeBytes != int64(buf.Len()) {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	if _, err := transform.Apply(context.Background(), testMsg, strings.NewReader("PK\x03\x04junk")); !errors.Is(err, ErrCorruptZip) {
+		t.Errorf("Apply() on a broken zip error = %v, want ErrCorruptZip", err)
+	}
+	if _, err := transformFor("gzip"); err == nil {
+		t.Error("transformFor() accepted an unknown transform")
+	}
+}
+
+// failingReader returns some bytes and then err.
+type failingReader struct {
+	sent bool
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, "PK\x03\x04partial"), nil
+	}
+	return 0, r.err
+}
+
+func TestUploadToBucketWriteError(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageOnce = sync.Once{}
+	storageOnce.Do(func() { storageClient = client })
+	defer func() { storageOnce, storageClient = sync.Once{}, nil }()
+
+	before := runtime.NumGoroutine()
+	readErr := errors.New("connection reset by peer")
+	err = UploadToBucket(context.Background(), "a1/u1/s1", testMsg, &failingReader{err: readErr})
+	if !errors.Is(err, readErr) {
+		t.Fatalf("UploadToBucket() error = %v, want %v", err, readErr)
+	}
+
+	// The writer's upload goroutine must be gone once UploadToBucket returns.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after a failed upload, %d before", n, before)
+	}
+	// The body never filled a chunk, so nothing was sent that could have
+	// been finalised as a partial object.
+	if n := requests.Load(); n != 0 {
+		t.Errorf("server got %d requests for a failed upload", n)
+	}
+}
+
+func TestUploadToBucketRetries(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("GCS_UPLOAD_MAX_RETRIES", "2")
+	t.Setenv("GCS_UPLOAD_BACKOFF_MS", "1")
+
+	tests := []struct {
+		name         string
+		failures     int32
+		wantRequests int32
+		wantErr      error
+	}{
+		{name: "retried", failures: 1, wantRequests: 2},
+		{name: "exhausted", failures: 100, wantRequests: 3, wantErr: ErrUploadRetriesExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				if requests.Add(1) <= tt.failures {
+					http.Error(w, "backend error", http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"bucket": "bucket", "name": "a1/u1/s1", "generation": "1"}`)
+			}))
+			defer srv.Close()
+
+			client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+			if err != nil {
+				t.Fatal(err)
+			}
+			storageOnce = sync.Once{}
+			storageOnce.Do(func() { storageClient = client })
+			defer func() { storageOnce, storageClient = sync.Once{}, nil }()
+
+			err = UploadToBucket(context.Background(), "a1/u1/s1", testMsg, strings.NewReader("PK\x03\x04data"))
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("UploadToBucket() error = %v, want nil", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("UploadToBucket() error = %v, want %v", err, tt.wantErr)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestUploadToBucketObjectACL(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	var mu sync.Mutex
+	var acls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		acls = append(acls, r.URL.Query().Get("predefinedAcl"))
+		mu.Unlock()
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"bucket": "bucket", "name": "a1/u1/s1", "generation": "1"}`)
+	}))
+	defer srv.Close()
+
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageOnce = sync.Once{}
+	storageOnce.Do(func() { storageClient = client })
+	defer func() { storageOnce, storageClient = sync.Once{}, nil }()
+
+	for _, acl := range []string{"", "projectPrivate", ObjectACLNone} {
+		t.Setenv("OBJECT_ACL", acl)
+		if err := UploadToBucket(context.Background(), "a1/u1/s1", testMsg, strings.NewReader("PK\x03\x04data")); err != nil {
+			t.Fatalf("OBJECT_ACL=%q: UploadToBucket() error = %v", acl, err)
+		}
+	}
+	if want := []string{"private", "projectPrivate", ""}; !reflect.DeepEqual(acls, want) {
+		t.Errorf("predefinedAcl = %q, want %q", acls, want)
+	}
+
+	t.Setenv("OBJECT_ACL", "public-read")
+	if got := objectACL(); got != "private" {
+		t.Errorf("objectACL() for an unknown value = %q, want private", got)
+	}
+}
+
+func TestGCPCredentials(t *testing.T) {
+	for _, key := range requiredEnv {
+		t.Setenv(key, "x")
+	}
+	t.Setenv("STORAGE_BACKEND", "gcs")
+	t.Setenv("GCP_CREDS_JSON", "{not json")
+	reset := func() { gcpCredsOnce, gcpCredsOpt, gcpCredsErr = sync.Once{}, nil, nil }
+	reset()
+	defer reset()
+
+	err := CheckConfig()
+	if !errors.Is(err, ErrInvalidGCPCredentials) {
+		t.Fatalf("CheckConfig() error = %v, want ErrInvalidGCPCredentials", err)
+	}
+	if _, serr := getStorageClient(); !errors.Is(serr, ErrInvalidGCPCredentials) {
+		t.Errorf("getStorageClient() error = %v, want ErrInvalidGCPCredentials", serr)
+	}
+
+	// The variable cannot change within a container, so fixing it in the
+	// environment does not clear the cached error.
+	t.Setenv("GCP_CREDS_JSON", `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`)
+	if again := CheckConfig(); again == nil || again.Error() != err.Error() {
+		t.Errorf("second CheckConfig() error = %v, want the cached %v", again, err)
+	}
+
+	reset()
+	if err := CheckConfig(); err != nil {
+		t.Errorf("CheckConfig() with valid credentials error = %v", err)
+	}
+}
+
+func TestLoadBodyTemplates(t *testing.T) {
+	defer func() { bodyTemplates = builtinBodyTemplates }()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "FILE_TOO_LARGE.txt"), []byte("{{.AssignmentId}} is too big"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MAIL_TEMPLATE_SOURCE", dir)
+	t.Setenv("MAIL_TEMPLATE_SUCCESS", "Uploaded {{.SubmissionId}} to {{.BucketPath}}")
+	t.Setenv("BUCKET", "bucket")
+
+	if err := LoadBodyTemplates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testMsg
+	if got, want := GenerateBody(StatusSuccess, msg, "key", BodyOptions{}), "Uploaded "+msg.SubmissionId+" to gs://bucket/key"; got != want {
+		t.Errorf("success body = %q, want %q", got, want)
+	}
+	if got, want := GenerateBody(StatusFileTooLarge, msg, "", BodyOptions{}), msg.AssignmentId+" is too big"; got != want {
+		t.Errorf("too large body = %q, want %q", got, want)
+	}
+	if got := GenerateBody(StatusCorruptZip, msg, "", BodyOptions{}); !strings.Contains(got, "zip file is corrupt") {
+		t.Errorf("corrupt zip body = %q, want default wording", got)
+	}
+	if got := GenerateBody(StatusUnreachable, msg, "", BodyOptions{DownloadStatusCode: 404}); !strings.Contains(got, "returned HTTP status 404") {
+		t.Errorf("unreachable body = %q, want the link's status", got)
+	}
+	if got := GenerateBody(StatusNotZip, msg, "", BodyOptions{ContentType: "text/html"}); !strings.Contains(got, "content of type text/html") {
+		t.Errorf("not zip body = %q, want the content type", got)
+	}
+
+	t.Setenv("MAIL_TEMPLATE_SUCCESS", "{{.Missing")
+	if err := LoadBodyTemplates(context.Background()); err == nil {
+		t.Error("expected a parse error")
+	}
+}
+
+func TestGenerateBodyLocale(t *testing.T) {
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{locale: "", want: "Hello,"},
+		{locale: "es", want: "Hola,"},
+		{locale: "es-MX", want: "Hola,"},
+		{locale: "xx", want: "Hello,"},
+	}
+
+	for _, tt := range tests {
+		msg := testMsg
+		msg.Locale = tt.locale
+		body := GenerateBody(StatusFileTooLarge, msg, "", BodyOptions{})
+		if !strings.HasPrefix(body, tt.want) {
+			t.Errorf("locale %q: body = %q, want prefix %q", tt.locale, body, tt.want)
+		}
+		if html, _ := GenerateHTMLBody(StatusFileTooLarge, msg, "", BodyOptions{}); (html == "") != (tt.want != "Hello,") {
+			t.Errorf("locale %q: unexpected HTML body %q", tt.locale, html)
+		}
+	}
+}
+
+func TestParseRouting(t *testing.T) {
+	entity := events.SNSEntity{MessageAttributes: map[string]interface{}{
+		"priority":       map[string]interface{}{"Type": "String", "Value": "HIGH"},
+		"assignmentType": map[string]interface{}{"Type": "String", "Value": "lab"},
+		"course":         map[string]interface{}{"Type": "String", "Value": "csye6225"},
+	}}
+
+	routing, ignored := parseRouting(entity)
+	if !routing.HighPriority || routing.AssignmentType != "lab" {
+		t.Errorf("routing = %+v", routing)
+	}
+	if len(ignored) != 1 || ignored[0] != "course" {
+		t.Errorf("ignored = %v, want [course]", ignored)
+	}
+
+	ctx := context.WithValue(context.Background(), routingKey{}, routing)
+	if got := retryBudget(ctx, 3); got != 6 {
+		t.Errorf("retryBudget = %d, want 6", got)
+	}
+	if got := retryBudget(context.Background(), 3); got != 3 {
+		t.Errorf("retryBudget without routing = %d, want 3", got)
+	}
+}
+
+func TestValidateObjectKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "valid", key: "asg-1/user-1/sub-1"},
+		{name: "max length", key: strings.Repeat("a", 1024)},
+		{name: "too long", key: strings.Repeat("a", 1025), wantErr: true},
+		{name: "invalid utf-8", key: "asg/\xff", wantErr: true},
+		{name: "newline", key: "asg/\nsub", wantErr: true},
+		{name: "leading dot", key: ".hidden/sub", wantErr: true},
+		{name: "empty", key: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateObjectKey(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidObjectKey) {
+				t.Errorf("err = %v, want ErrInvalidObjectKey", err)
+			}
+		})
+	}
+}
+
+func TestFillReceiptFromError(t *testing.T) {
+	var receipt MailReceipt
+	fillReceiptFromError(&receipt, &mailgun.UnexpectedResponseError{
+		Expected: []int{http.StatusOK},
+		Actual:   http.StatusBadRequest,
+		Data:     []byte(`{"id":"<abc@mailgun>","message":"'to' parameter is not a valid address"}`),
+	})
+	if receipt.StatusCode != http.StatusBadRequest || receipt.Id != "<abc@mailgun>" || receipt.Response == "" {
+		t.Errorf("receipt = %+v", receipt)
+	}
+
+	receipt = MailReceipt{}
+	fillReceiptFromError(&receipt, errors.New("connection reset"))
+	if receipt.StatusCode != 0 || receipt.Id != "" {
+		t.Errorf("receipt for network error = %+v", receipt)
+	}
+}
+
+func TestGenerateBodyStorageBackend(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("STORAGE_BACKEND", BackendS3)
+
+	if got := GenerateBody(StatusSuccess, testMsg, "key", BodyOptions{}); !strings.Contains(got, "s3://bucket/key") {
+		t.Errorf("success body = %q, want s3:// path", got)
+	}
+	if got := GenerateBody(StatusUploadFailed, testMsg, "", BodyOptions{}); !strings.Contains(got, "S3 bucket") {
+		t.Errorf("upload failed body = %q, want S3 wording", got)
+	}
+}
+
+func TestRecordResultJSON(t *testing.T) {
+	b, err := json.Marshal(RecordResult{MessageId: "sns-1", CorrelationId: "c-1", SubmissionId: "sub-1", MailStatus: StatusSuccess, MailSent: true, retryable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"MessageId":"sns-1","CorrelationId":"c-1","SubmissionId":"sub-1","MailStatus":"SUCCESS","MailSent":true}`
+	if string(b) != want {
+		t.Errorf("json = %s, want %s", b, want)
+	}
+}
+
+func TestDownloadBlockedHosts(t *testing.T) {
+	t.Setenv("DOWNLOAD_MAX_RETRIES", "0")
+	t.Setenv("MIN_DOWNLOAD_BYTES", "0")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		io.WriteString(w, "PK\x03\x04data")
+	}))
+	defer srv.Close()
+
+	if _, err := Download(context.Background(), srv.URL); !errors.Is(err, ErrBlockedHost) {
+		t.Errorf("loopback: err = %v, want ErrBlockedHost", err)
+	}
+
+	t.Setenv("DOWNLOAD_ALLOW_PRIVATE", "true")
+	t.Setenv("BLOCKED_CIDRS", "127.0.0.0/8")
+	if _, err := Download(context.Background(), srv.URL); !errors.Is(err, ErrBlockedHost) {
+		t.Errorf("blocked cidr: err = %v, want ErrBlockedHost", err)
+	}
+
+	t.Setenv("BLOCKED_CIDRS", "")
+	t.Setenv("ALLOWED_DOWNLOAD_HOSTS", ".example.com")
+	if _, err := Download(context.Background(), srv.URL); !errors.Is(err, ErrBlockedHost) {
+		t.Errorf("allowlist: err = %v, want ErrBlockedHost", err)
+	}
+
+	t.Setenv("ALLOWED_DOWNLOAD_HOSTS", "127.0.0.1")
+	body, err := Download(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("allowed host: unexpected error: %v", err)
+	}
+	body.Close()
+}
+
+func TestDownloadAuthHeader(t *testing.T) {
+	t.Setenv("DOWNLOAD_ALLOW_PRIVATE", "true")
+	t.Setenv("MIN_DOWNLOAD_BYTES", "0")
+	t.Setenv("DOWNLOAD_AUTH_HEADER", "Bearer secret")
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/zip")
+		io.WriteString(w, "PK\x03\x04data")
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		hosts string
+		want  string
+	}{
+		{hosts: "", want: ""},
+		{hosts: "github.com", want: ""},
+		{hosts: "127.0.0.1", want: "Bearer secret"},
+	} {
+		t.Setenv("DOWNLOAD_AUTH_HOSTS", tt.hosts)
+		got = ""
+		body, err := Download(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+		if got != tt.want {
+			t.Errorf("hosts %q: Authorization = %q, want %q", tt.hosts, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadTLS(t *testing.T) {
+	t.Setenv("DOWNLOAD_ALLOW_PRIVATE", "true")
+	t.Setenv("DOWNLOAD_MAX_RETRIES", "0")
+	t.Setenv("MIN_DOWNLOAD_BYTES", "0")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		io.WriteString(w, "PK\x03\x04data")
+	}))
+	defer srv.Close()
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte(caPEM), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c *http.Client) { downloadClient = c }(downloadClient)
+
+	tests := []struct {
+		name     string
+		bundle   string
+		insecure string
+		wantErr  bool
+	}{
+		{name: "default trust store", wantErr: true},
+		{name: "PEM bundle", bundle: caPEM},
+		{name: "bundle file", bundle: caFile},
+		{name: "insecure", insecure: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOWNLOAD_CA_BUNDLE", tt.bundle)
+			t.Setenv("DOWNLOAD_TLS_INSECURE_SKIP_VERIFY", tt.insecure)
+			downloadClient = newDownloadClient()
+
+			body, err := Download(context.Background(), srv.URL)
+			if tt.wantErr {
+				if err == nil {
+					body.Close()
+					t.Fatal("expected a certificate error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Download() error = %v", err)
+			}
+			body.Close()
+		})
+	}
+
+	t.Setenv("DOWNLOAD_CA_BUNDLE", "-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----")
+	if _, err := downloadTLSConfig(); err == nil {
+		t.Error("expected an error for a bundle without certificates")
+	}
+}
+
+func TestDownloadSlowBody(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("DOWNLOAD_ALLOW_PRIVATE", "true")
+	t.Setenv("DOWNLOAD_MAX_RETRIES", "0")
+	t.Setenv("DOWNLOAD_TIMEOUT_SECONDS", "1")
+	t.Setenv("MIN_DOWNLOAD_BYTES", "0")
+	defer func(c *http.Client) { downloadClient = c }(downloadClient)
+	downloadClient = newDownloadClient()
+
+	// The headers arrive at once but the body takes longer than
+	// DOWNLOAD_TIMEOUT_SECONDS, as a large upload on a slow link would.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stalled" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		io.WriteString(w, "PK\x03\x04")
+		w.(http.Flusher).Flush()
+		for i := 0; i < 6; i++ {
+			time.Sleep(250 * time.Millisecond)
+			io.WriteString(w, "data")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantReason string
+	}{
+		{name: "slow body", path: "/slow"},
+		{name: "headers too late", path: "/stalled", wantReason: "transient"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploader := &fakeUploader{}
+			p := &Processor{
+				Downloader: httpDownloader{},
+				Uploader:   uploader,
+				Mailer:     &fakeMailer{},
+				Recorder:   &fakeRecorder{},
+			}
+			msg := testMsg
+			msg.SubmissionUrl = srv.URL + tt.path
+			result := p.ProcessRecord(context.Background(), testRecord(t, msg))
+
+			if tt.wantReason != "" {
+				if result.Failure == nil || result.Failure.Stage != StageDownload || result.Failure.Reason != tt.wantReason {
+					t.Fatalf("Failure = %+v, want a %s download failure", result.Failure, tt.wantReason)
+				}
+				return
+			}
+			if result.Failure != nil {
+				t.Fatalf("Failure = %+v, want the slow upload to finish", result.Failure)
+			}
+			if want := "PK\x03\x04" + strings.Repeat("data", 6); uploader.uploaded != want {
+				t.Errorf("uploaded = %q, want %q", uploader.uploaded, want)
+			}
+		})
+	}
+}
+
+func TestReprocess(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+
+	mailer := &fakeMailer{err: errors.New("mailgun down")}
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   &fakeUploader{},
+		Mailer:     mailer,
+		Recorder:   recorder,
+		// A warm container still remembers the first run's claim.
+		Recent: newRecentSubmissions(10),
+	}
+
+	if result := p.ProcessRecord(context.Background(), testRecord(t, testMsg)); result.MailSent {
+		t.Fatal("expected the first send to fail")
+	}
+
+	mailer.err = nil
+	out, err := p.Reprocess(context.Background(), testMsg.SubmissionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []RecordResult
+	if err := json.Unmarshal([]byte(*out), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0].MailSent || results[0].MailStatus == StatusDuplicate {
+		t.Errorf("results = %+v", results)
+	}
+	if len(recorder.items) != 2 {
+		t.Errorf("recorded %d items, want 2", len(recorder.items))
+	}
+
+	if _, err := p.Reprocess(context.Background(), "unknown"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("err = %v, want ErrRecordNotFound", err)
+	}
+
+	// A replay that reaches the outcome already mailed, e.g. SUCCESS again
+	// after the object was lost, still mails the student.
+	tokens := &tokenRecorder{fakeRecorder: &fakeRecorder{}, sent: map[string]bool{}}
+	mailer = &fakeMailer{}
+	p.Mailer, p.Recorder, p.Recent = mailer, tokens, newRecentSubmissions(10)
+	if result := p.ProcessRecord(context.Background(), testRecord(t, testMsg)); !result.MailSent {
+		t.Fatalf("first run: %+v", result)
+	}
+	mailer.body = ""
+	out, err = p.Reprocess(context.Background(), testMsg.SubmissionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results = nil
+	if err := json.Unmarshal([]byte(*out), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0].MailSent || results[0].MailDeduped || mailer.body == "" {
+		t.Errorf("replay results = %+v, want the success mailed again", results)
+	}
+	if !tokens.sent[MailToken(testMsg.SubmissionId, StatusSuccess)] {
+		t.Error("mail token not kept as sent after the replay")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Setenv("DRY_RUN", "true")
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("MAIL_TABLE", "mail")
+	t.Setenv("STORAGE_BACKEND", "gcs")
+	t.Setenv("MAILGUN_DOMAIN", "mg.example.com")
+	t.Setenv("MAILGUN_PVT_API_KEY", "key-test")
+
+	// Every backend the real clients would reach counts its requests; a dry
+	// run must not send any.
+	var requests atomic.Int32
+	count := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+	})
+	gcs := httptest.NewServer(count)
+	defer gcs.Close()
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(gcs.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageOnce = sync.Once{}
+	storageOnce.Do(func() { storageClient = client })
+	defer func() { storageOnce, storageClient = sync.Once{}, nil }()
+	useFakeDynamo(t, count)
+	mg := httptest.NewServer(count)
+	defer mg.Close()
+	t.Setenv("MAILGUN_API_BASE", mg.URL+"/v3")
+	mailgunOnce, mailgunClient = sync.Once{}, nil
+	defer func() { mailgunOnce, mailgunClient = sync.Once{}, nil }()
+
+	p := NewProcessor()
+	if !p.DryRun {
+		t.Fatal("NewProcessor() with DRY_RUN=true is not a dry run")
+	}
+	p.Downloader = &fakeDownloader{body: "PK\x03\x04data"}
+
+	out, err := p.HandleRequest(context.Background(), events.SNSEvent{Records: []events.SNSEventRecord{testRecord(t, testMsg)}})
+	if err != nil {
+		t.Fatalf("HandleRequest() error = %v", err)
+	}
+	var results []RecordResult
+	if err := json.Unmarshal([]byte(*out), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].MailStatus != StatusSuccess || results[0].MailBody == "" {
+		t.Errorf("results = %+v, want one success with the mail body", results)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("a dry run sent %d requests to GCS, DynamoDB or Mailgun", n)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("MAIL_TABLE", "mail")
+	t.Setenv("DEAD_LETTER_TABLE", "")
+	t.Setenv("IDEMPOTENCY_TABLE", "")
+	t.Setenv("STORAGE_BACKEND", "gcs")
+	t.Setenv("MAILGUN_DOMAIN", "mg.example.com")
+	t.Setenv("MAILGUN_PVT_API_KEY", "key-test")
+
+	tests := []struct {
+		name       string
+		failing    string
+		wantFailed string
+	}{
+		{name: "all reachable"},
+		{name: "bucket missing", failing: "gcs", wantFailed: "gcs"},
+		{name: "table missing", failing: "dynamodb", wantFailed: "dynamodb:mail"},
+		{name: "mailgun unauthorised", failing: "mailgun", wantFailed: "mailgun"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.failing == "gcs" {
+					http.Error(w, `{"error": {"code": 404, "message": "Not Found"}}`, http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"name": "bucket", "location": "US"}`)
+			}))
+			defer gcs.Close()
+			client, err := storage.NewClient(context.Background(), option.WithEndpoint(gcs.URL+"/storage/v1/"), option.WithoutAuthentication())
+			if err != nil {
+				t.Fatal(err)
+			}
+			storageOnce = sync.Once{}
+			storageOnce.Do(func() { storageClient = client })
+			defer func() { storageOnce, storageClient = sync.Once{}, nil }()
+
+			useFakeDynamo(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+				if tt.failing == "dynamodb" {
+					w.WriteHeader(http.StatusBadRequest)
+					io.WriteString(w, `{"__type": "com.amazonaws.dynamodb.v20120810#ResourceNotFoundException", "message": "Requested resource not found"}`)
+					return
+				}
+				io.WriteString(w, `{"Table": {"TableName": "mail", "TableStatus": "ACTIVE", "KeySchema": [{"AttributeName": "SubmissionId", "KeyType": "HASH"}, {"AttributeName": "RecordId", "KeyType": "RANGE"}]}}`)
+			})
+
+			mg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.failing == "mailgun" {
+					http.Error(w, "Forbidden", http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"domain": {"name": "mg.example.com", "state": "active"}}`)
+			}))
+			defer mg.Close()
+			t.Setenv("MAILGUN_API_BASE", mg.URL+"/v3")
+			mailgunOnce, mailgunClient = sync.Once{}, nil
+			defer func() { mailgunOnce, mailgunClient = sync.Once{}, nil }()
+
+			report := SelfTest(context.Background())
+			if report.Ok != (tt.wantFailed == "") {
+				t.Errorf("Ok = %v, checks = %+v", report.Ok, report.Checks)
+			}
+			if len(report.Checks) != 3 {
+				t.Fatalf("got %d checks, want gcs, dynamodb:mail and mailgun: %+v", len(report.Checks), report.Checks)
+			}
+			for _, c := range report.Checks {
+				if wantOk := c.Name != tt.wantFailed; c.Ok != wantOk {
+					t.Errorf("check %s: Ok = %v, want %v (error %q)", c.Name, c.Ok, wantOk, c.Error)
+				}
+				if !c.Ok && c.Error == "" {
+					t.Errorf("check %s failed without an error", c.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestPipelineErrorMarshal(t *testing.T) {
+	perr := newPipelineError(StageDownload, downloadFailureReason(ErrUnreachable), fmt.Errorf("%w: status 404", ErrUnreachable))
+	if !errors.Is(perr, ErrUnreachable) {
+		t.Error("PipelineError should unwrap to the stage error")
+	}
+
+	b, err := json.Marshal(perr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Stage":"download","Reason":"unreachable","Message":"Submission URL not reachable: status 404"}`; string(b) != want {
+		t.Errorf("json = %s, want %s", b, want)
+	}
+
+	av, err := dynamodbattribute.MarshalMap(Item{MessageId: "sns-1", Failure: perr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := av["Failure"].M
+	if failure == nil || aws.StringValue(failure["Reason"].S) != "unreachable" || failure["Err"] != nil {
+		t.Errorf("Failure attribute = %v", av["Failure"])
+	}
+}
+
+func TestMailSubject(t *testing.T) {
+	t.Setenv("SUBJECT", "Submission update")
+	t.Setenv("MAIL_SUBJECT_SUCCESS", "Assignment {AssignmentId} received")
+	t.Setenv("MAIL_SUBJECT_FAILURE", "Action needed for {AssignmentId}")
+	t.Setenv("MAIL_SUBJECT_FILE_TOO_LARGE", "Submission too large")
+
+	tests := []struct {
+		status MailStatus
+		want   string
+	}{
+		{status: StatusSuccess, want: "Assignment asg-1 received"},
+		{status: StatusDownloadFailed, want: "Action needed for asg-1"},
+		{status: StatusFileTooLarge, want: "Submission too large"},
+	}
+	for _, tt := range tests {
+		if got := MailSubject(tt.status, testMsg); got != tt.want {
+			t.Errorf("MailSubject(%s) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+
+	t.Setenv("MAIL_SUBJECT_FAILURE", "")
+	if got := MailSubject(StatusUploadFailed, testMsg); got != "Submission update" {
+		t.Errorf("fallback subject = %q", got)
+	}
+}
+
+func TestMailSender(t *testing.T) {
+	tests := []struct {
+		sender string
+		name   string
+		want   string
+	}{
+		{sender: "noreply@course.edu", want: "noreply@course.edu"},
+		{sender: "noreply@course.edu", name: "Course Staff", want: `"Course Staff" <noreply@course.edu>`},
+		{sender: "Course Staff <noreply@course.edu>", name: "Ignored", want: `"Course Staff" <noreply@course.edu>`},
+		{sender: "noreply@course.edu", name: "Équipe du cours", want: "=?utf-8?q?=C3=89quipe_du_cours?= <noreply@course.edu>"},
+		{sender: "not an address", want: "not an address"},
+	}
+	for _, tt := range tests {
+		t.Setenv("SENDER", tt.sender)
+		t.Setenv("SENDER_NAME", tt.name)
+		if got := MailSender(); got != tt.want {
+			t.Errorf("MailSender(%q, %q) = %q, want %q", tt.sender, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMailTagsAndHeaders(t *testing.T) {
+	msg := testMsg
+	msg.AssignmentId = "HW1 ✓"
+
+	t.Setenv("MAIL_TAGS", "cs101, fall-2026")
+	tags, err := MailTags(msg)
+	if err != nil || !reflect.DeepEqual(tags, []string{"cs101", "fall-2026", "HW1 _"}) {
+		t.Errorf("MailTags() = %q, %v", tags, err)
+	}
+
+	t.Setenv("MAIL_TAGS", "a,b,c")
+	if tags, err := MailTags(msg); err == nil || len(tags) != mailgun.MaxNumberOfTags {
+		t.Errorf("MailTags() over the limit = %q, %v, want %d tags and an error", tags, err, mailgun.MaxNumberOfTags)
+	}
+
+	t.Setenv("MAIL_HEADERS", "x-course-id=CS101, X-Term = Fall")
+	headers, err := MailHeaders(msg)
+	want := map[string]string{"X-Course-Id": "CS101", "X-Term": "Fall", "X-Assignment-Id": "HW1 ✓"}
+	if err != nil || !reflect.DeepEqual(headers, want) {
+		t.Errorf("MailHeaders() = %v, %v, want %v", headers, err, want)
+	}
+
+	for _, spec := range []string{"X-Course-Id", "X Course=1", "=CS101"} {
+		t.Setenv("MAIL_HEADERS", spec)
+		if _, err := MailHeaders(msg); err == nil {
+			t.Errorf("MailHeaders() accepted MAIL_HEADERS=%q", spec)
+		}
+	}
+}
+
+func TestObjectLabels(t *testing.T) {
+	at := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+	msg := testMsg
+	msg.AssignmentId = "CS 101/HW#1"
+
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "default", want: map[string]string{"assignment": "cs_101_hw_1", "submitted-at": "2026-10-14"}},
+		{name: "disabled", spec: "-", want: nil},
+		{name: "sanitised", spec: "Term=Fall 2026, 9lives={UserId}, empty={AssignmentType}", want: map[string]string{"term": "fall_2026", "l9lives": "user-1"}},
+		{name: "truncated", spec: "k=" + strings.Repeat("a", 80), want: map[string]string{"k": strings.Repeat("a", maxLabelLength)}},
+		{name: "unknown placeholder", spec: "term={Term}", wantErr: true},
+		{name: "not a pair", spec: "term", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ObjectLabels(tt.spec, msg, at)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("labels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3Tagging(t *testing.T) {
+	labels := map[string]string{}
+	for i := 0; i < 11; i++ {
+		labels[fmt.Sprintf("k%02d", i)] = "v"
+	}
+
+	tags, err := url.ParseQuery(aws.StringValue(s3Tagging(context.Background(), labels)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != maxS3Tags {
+		t.Errorf("got %d tags, want %d", len(tags), maxS3Tags)
+	}
+	if tags.Has("k10") || !tags.Has("k00") || !tags.Has("k09") {
+		t.Errorf("tags = %v, want k00 to k09", tags)
+	}
+
+	if got := s3Tagging(context.Background(), nil); got != nil {
+		t.Errorf("s3Tagging(nil) = %q, want nil", *got)
+	}
+}
+
+func TestWaitMailLimiter(t *testing.T) {
+	t.Setenv("MAILGUN_RATE_PER_SEC", "0.5")
+	mailLimiterOnce, mailLimiter = sync.Once{}, nil
+	defer func() { mailLimiterOnce, mailLimiter = sync.Once{}, nil }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := waitMailLimiter(ctx); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	start := time.Now()
+	err := waitMailLimiter(ctx)
+	if !errors.Is(err, ErrMailRateLimited) {
+		t.Errorf("err = %v, want ErrMailRateLimited", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("waited %v instead of failing fast", elapsed)
+	}
+}
+
+func TestSendMailStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		message    string
+		wantStatus string
+		wantErr    error
+	}{
+		{name: "queued", status: http.StatusOK, message: "Queued. Thank you.", wantStatus: MailgunQueued},
+		{name: "accepted", status: http.StatusOK, message: "Accepted", wantStatus: MailgunAccepted},
+		{name: "2xx not queued", status: http.StatusOK, message: "Domain is disabled", wantStatus: MailgunRejected, wantErr: ErrMailNotAccepted},
+		{name: "4xx", status: http.StatusBadRequest, message: "'to' parameter is not a valid address", wantStatus: MailgunRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				json.NewEncoder(w).Encode(map[string]string{"id": "<id@mailgun>", "message": tt.message})
+			}))
+			defer srv.Close()
+			t.Setenv("MAILGUN_API_BASE", srv.URL+"/v3")
+			t.Setenv("MAILGUN_DOMAIN", "mg.example.com")
+			t.Setenv("MAILGUN_PVT_API_KEY", "key-test")
+			t.Setenv("SENDER", "grader@example.com")
+			t.Setenv("MAIL_MAX_RETRIES", "0")
+			mailgunOnce, mailgunClient = sync.Once{}, nil
+			defer func() { mailgunOnce, mailgunClient = sync.Once{}, nil }()
+
+			receipt, err := SendMail(context.Background(), Email{To: []string{"student@example.com"}, Body: "hi"})
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.status == http.StatusOK && tt.wantErr == nil && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+			if tt.status != http.StatusOK && err == nil {
+				t.Error("err = nil for a 4xx reply")
+			}
+			if receipt.Status != tt.wantStatus {
+				t.Errorf("Status = %q, want %q", receipt.Status, tt.wantStatus)
+			}
+			if receipt.Response != tt.message {
+				t.Errorf("Response = %q, want %q", receipt.Response, tt.message)
+			}
+		})
+	}
+}
+
+func TestAcquireInflight(t *testing.T) {
+	t.Setenv("MAX_INFLIGHT_BYTES", "100")
+	t.Setenv("MAX_DOWNLOAD_BYTES", "60")
+	inflightOnce, inflight, inflightMax = sync.Once{}, nil, 0
+	defer func() { inflightOnce, inflight, inflightMax = sync.Once{}, nil, 0 }()
+
+	first, err := acquireInflight(context.Background())
+	if err != nil {
+		t.Fatalf("first acquireInflight() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := acquireInflight(ctx); !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrInflightWait) {
+		t.Fatalf("second acquireInflight() error = %v, want it to block until the deadline", err)
+	}
+
+	first.shrink(30)
+	second, err := acquireInflight(context.Background())
+	if err != nil {
+		t.Fatalf("acquireInflight() after shrink error = %v", err)
+	}
+	first.release()
+	first.release()
+	second.release()
+	if !inflight.TryAcquire(100) {
+		t.Error("released reservations did not return the whole budget")
+	}
+}
+
+func TestProcessRecordInflightWait(t *testing.T) {
+	t.Setenv("BUCKET", "bucket")
+	t.Setenv("MAX_INFLIGHT_BYTES", "100")
+	t.Setenv("MAX_DOWNLOAD_BYTES", "100")
+	t.Setenv("LAMBDA_TIME_MARGIN_MS", "150")
+	inflightOnce, inflight, inflightMax = sync.Once{}, nil, 0
+	defer func() { inflightOnce, inflight, inflightMax = sync.Once{}, nil, 0 }()
+
+	// Another record holds the whole budget for the rest of the invocation.
+	held, err := acquireInflight(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.release()
+
+	mailer := &fakeMailer{}
+	recorder := &fakeRecorder{}
+	p := &Processor{
+		Downloader: panicDownloader{url: testMsg.SubmissionUrl},
+		Uploader:   &fakeUploader{},
+		Mailer:     mailer,
+		Recorder:   recorder,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result := p.ProcessRecord(ctx, testRecord(t, testMsg))
+
+	if ctx.Err() != nil {
+		t.Error("the wait used up the invocation instead of stopping at the transfer deadline")
+	}
+	if result.Failure == nil || result.Failure.Reason != "inflight_wait" || !errors.Is(result.Failure, ErrInflightWait) {
+		t.Fatalf("Failure = %+v, want inflight_wait", result.Failure)
+	}
+	if !result.retryable || !result.MailSkipped || mailer.recipient != "" {
+		t.Errorf("result = %+v, want a retryable failure without a mail", result)
+	}
+	if len(recorder.items) != 1 || recorder.items[0].Failure == nil || recorder.items[0].Failure.Reason != "inflight_wait" {
+		t.Errorf("items = %+v, want the inflight_wait failure recorded", recorder.items)
+	}
+}
+
+func TestMarshalItemAttributeNames(t *testing.T) {
+	item := Item{SubmissionId: "sub-1", RecordId: "r-1", FileSHA256: "abc", Failure: &PipelineError{Stage: StageMail, Reason: "send_failed", Message: "401"}}
+
+	tests := []struct {
+		name      string
+		naming    string
+		pk, sk    string
+		wantAttrs []string
+	}{
+		{name: "default", wantAttrs: []string{"SubmissionId", "RecordId", "FileSHA256", "Failure.Stage"}},
+		{name: "pk/sk", pk: "PK", sk: "SK", wantAttrs: []string{"PK", "SK", "FileSHA256", "MessageId"}},
+		{name: "snake", naming: "snake", wantAttrs: []string{"submission_id", "record_id", "file_sha256", "is_mail_sent", "failure.reason"}},
+		{name: "snake with keys", naming: "snake", pk: "PK", sk: "SK", wantAttrs: []string{"PK", "SK", "request_metadata"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAIL_TABLE_ATTRIBUTE_CASE", tt.naming)
+			t.Setenv("MAIL_TABLE_PARTITION_KEY", tt.pk)
+			t.Setenv("MAIL_TABLE_SORT_KEY", tt.sk)
+
+			av, err := marshalItem(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, attr := range tt.wantAttrs {
+				name, nested, _ := strings.Cut(attr, ".")
+				v, ok := av[name]
+				if ok && nested != "" {
+					_, ok = v.M[nested]
+				}
+				if !ok {
+					t.Errorf("missing attribute %s in %v", attr, av)
+				}
+			}
+			if got := itemString(av, "SubmissionId"); got != "sub-1" {
+				t.Errorf("itemString(SubmissionId) = %q", got)
+			}
+		})
+	}
+}
+
+func TestProcessRecordArchive(t *testing.T) {
+	archiver := &fakeArchiver{}
+	p := &Processor{
+		Downloader: &fakeDownloader{body: "PK\x03\x04data"},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   &fakeRecorder{},
+		Archiver:   archiver,
+	}
+	record := testRecord(t, testMsg)
+
+	p.ProcessRecord(context.Background(), record)
+
+	if len(archiver.keys) != 1 {
+		t.Fatalf("archived %d events, want 1", len(archiver.keys))
+	}
+	if !strings.HasPrefix(archiver.keys[0], "events/sub-1/") || !strings.HasSuffix(archiver.keys[0], "-"+record.SNS.MessageID+".json") {
+		t.Errorf("key = %q", archiver.keys[0])
+	}
+	var archived events.SNSEventRecord
+	if err := json.Unmarshal(archiver.data[0], &archived); err != nil || archived.SNS.Message != record.SNS.Message {
+		t.Errorf("archived record = %+v, %v", archived, err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	t.Setenv("DIGEST_RECIPIENT", "staff@example.com")
+
+	records := []events.SNSEventRecord{}
+	for i := 0; i < 2; i++ {
+		msg := testMsg
+		msg.SubmissionId = fmt.Sprintf("sub-%d", i)
+		records = append(records, testRecord(t, msg))
+	}
+
+	t.Run("bcc", func(t *testing.T) {
+		mailer := &fakeMailer{}
+		p := &Processor{Downloader: &fakeDownloader{body: "PK\x03\x04data"}, Uploader: &fakeUploader{}, Mailer: mailer, Recorder: &fakeRecorder{}}
+		p.ProcessRecord(context.Background(), records[0])
+		if strings.Join(mailer.email.Bcc, ",") != "staff@example.com" {
+			t.Errorf("Bcc = %v", mailer.email.Bcc)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		t.Setenv("DIGEST_MODE", DigestBatch)
+		t.Setenv("MAX_CONCURRENCY", "1")
+		mailer := &fakeMailer{}
+		p := &Processor{Downloader: &fakeDownloader{body: "PK\x03\x04data"}, Uploader: &fakeUploader{}, Mailer: mailer, Recorder: &fakeRecorder{}}
+		if _, err := p.HandleRequest(context.Background(), events.SNSEvent{Records: records}); err != nil {
+			t.Fatal(err)
+		}
+		if mailer.recipient != "staff@example.com" {
+			t.Fatalf("last mail went to %q, want the digest recipient", mailer.recipient)
+		}
+		if !strings.Contains(mailer.body, "sub-0: SUCCESS, mailed") || !strings.Contains(mailer.body, "sub-1: SUCCESS, mailed") {
+			t.Errorf("digest body = %q", mailer.body)
+		}
+		if len(mailer.email.Bcc) != 0 {
+			t.Errorf("Bcc = %v, want none in batch mode", mailer.email.Bcc)
+		}
+	})
+}
+
+func TestValidateRecipient(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "student@example.com"},
+		{addr: " student@mail.example.edu "},
+		{addr: "student@localhost", wantErr: true},
+		{addr: "Student <student@example.com>", wantErr: true},
+		{addr: "student.example.com", wantErr: true},
+		{addr: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := ValidateRecipient(context.Background(), tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateRecipient(%q) = %v, wantErr %v", tt.addr, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidRecipient) {
+			t.Errorf("ValidateRecipient(%q) = %v, want ErrInvalidRecipient", tt.addr, err)
+		}
+	}
+
+	p := &Processor{Downloader: &fakeDownloader{}, Uploader: &fakeUploader{}, Mailer: &fakeMailer{}, Recorder: &fakeRecorder{}}
+	msg := testMsg
+	msg.SubmissionEmail = "student@localhost"
+	result := p.ProcessRecord(context.Background(), testRecord(t, msg))
+	if result.Failure == nil || result.Failure.Reason != "invalid_recipient" {
+		t.Errorf("Failure = %+v, want invalid_recipient", result.Failure)
+	}
+}
+
+func TestFailureAlert(t *testing.T) {
+	alerter := &fakeAlerter{err: errors.New("sns unavailable")}
+	p := &Processor{
+		Downloader: &fakeDownloader{err: errors.New("Not a zip file")},
+		Uploader:   &fakeUploader{},
+		Mailer:     &fakeMailer{},
+		Recorder:   &fakeRecorder{},
+		Alerter:    alerter,
+	}
+
+	out, err := p.HandleRequest(context.Background(), events.SNSEvent{Records: []events.SNSEventRecord{testRecord(t, testMsg)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerter.events) != 1 {
+		t.Fatalf("published %d events, want 1", len(alerter.events))
+	}
+	event := alerter.events[0]
+	if event.SubmissionId != "sub-1" || event.AssignmentId != "asg-1" || event.Stage != StageDownload || event.Reason != "download_failed" {
+		t.Errorf("event = %+v", event)
+	}
+	// A failed publish must not change the record's own outcome.
+	if !strings.Contains(*out, `"Reason":"download_failed"`) {
+		t.Errorf("output = %s", *out)
+	}
+
+	alerter.events = nil
+	p.Downloader = &fakeDownloader{body: "PK\x03\x04data"}
+	p.Recorder = &fakeRecorder{}
+	p.HandleRequest(context.Background(), events.SNSEvent{Records: []events.SNSEventRecord{testRecord(t, testMsg)}})
+	if len(alerter.events) != 0 {
+		t.Errorf("published %v for a successful record", alerter.events)
+	}
+}
+
+func TestRetryableReason(t *testing.T) {
+	if !RetryableReason("transient") || RetryableReason("not_zip") || RetryableReason("rate_limited") {
+		t.Error("unexpected default disposition")
+	}
+
+	t.Setenv("RETRY_OVERRIDES", "rate_limited=true, upload_failed=false")
+	if !RetryableReason("rate_limited") || RetryableReason("upload_failed") || !RetryableReason("transient") {
+		t.Error("RETRY_OVERRIDES not applied")
+	}
+}